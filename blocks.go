@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// BlockGraph is the control flow graph of the machine code of a function.
+type BlockGraph struct {
+	Text   []AsmInstruction
+	Blocks []*Block // in address order, Blocks[0] is the entry block
+
+	index     map[uint64]int    // instruction index of each pc
+	blockAt   map[uint64]*Block // block starting at each pc
+	reachable []bool
+}
+
+// Block is a basic block, the instructions Text[Start:End].
+type Block struct {
+	ID         int
+	Start, End int
+	In, Out    []*BlockEdge
+	Morestack  bool // part of the code growing the stack, reached from the stack check
+}
+
+type BlockEdgeKind uint8
+
+const (
+	BlockFallthrough BlockEdgeKind = iota // execution continues to the next instruction
+	BlockCond                             // conditional jump taken
+	BlockJump                             // unconditional jump
+	BlockTable                            // indirect jump through a jump table
+)
+
+type BlockEdge struct {
+	From, To *Block
+	Kind     BlockEdgeKind
+}
+
+// NewBlockGraph splits text into basic blocks and connects them.
+// Instructions after a return, an undefined instruction or a call to a
+// function in NoReturn end their block without successors. The Helper
+// field of the instructions of text is set.
+func NewBlockGraph(text []AsmInstruction, exe *Executable) *BlockGraph {
+	bg := &BlockGraph{Text: text, index: map[uint64]int{}, blockAt: map[uint64]*Block{}}
+	for i := range text {
+		if text[i].Pc != 0 {
+			bg.index[text[i].Pc] = i
+		}
+	}
+
+	leader := make([]bool, len(text)+1)
+	leader[0] = true
+	leader[len(text)] = true
+	jumps := map[int]int{} // destination of each jump
+	for i, inst := range text {
+		if destIdx := bg.jumpDest(inst); destIdx >= 0 {
+			jumps[i] = destIdx
+			leader[destIdx] = true
+			leader[i+1] = true
+		}
+		for _, dest := range inst.JumpTable {
+			if destIdx, ok := bg.index[dest]; ok {
+				leader[destIdx] = true
+			}
+			leader[i+1] = true
+		}
+		if endsPath(exe, inst) {
+			leader[i+1] = true
+		}
+	}
+
+	for i := 0; i < len(text); {
+		j := i + 1
+		for !leader[j] {
+			j++
+		}
+		b := &Block{ID: len(bg.Blocks), Start: i, End: j}
+		bg.Blocks = append(bg.Blocks, b)
+		bg.blockAt[text[i].Pc] = b
+		i = j
+	}
+
+	for k, b := range bg.Blocks {
+		last := text[b.End-1]
+		falls := !endsPath(exe, last) && last.Inst.Op != x86asm.JMP && last.Inst.Op != x86asm.LJMP
+		if destIdx, isjump := jumps[b.End-1]; isjump {
+			kind := BlockJump
+			if falls {
+				kind = BlockCond
+			}
+			bg.addEdge(b, bg.blockAt[text[destIdx].Pc], kind)
+		}
+		for _, dest := range last.JumpTable {
+			if to := bg.blockAt[dest]; to != nil {
+				bg.addEdge(b, to, BlockTable)
+			}
+		}
+		if falls && k+1 < len(bg.Blocks) {
+			bg.addEdge(b, bg.Blocks[k+1], BlockFallthrough)
+		}
+	}
+
+	if sc := stackCheckEnd(text); sc >= 0 {
+		if destIdx, isjump := jumps[sc-1]; isjump {
+			bg.markMorestack(bg.blockAt[text[destIdx].Pc], jumps)
+		}
+	}
+
+	bg.reachable = make([]bool, len(bg.Blocks))
+	if len(bg.Blocks) > 0 {
+		bg.reachable[0] = true
+		for stack := []*Block{bg.Blocks[0]}; len(stack) > 0; {
+			b := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, e := range b.Out {
+				if !bg.reachable[e.To.ID] {
+					bg.reachable[e.To.ID] = true
+					stack = append(stack, e.To)
+				}
+			}
+		}
+	}
+
+	bg.labelHelpers(exe)
+	bg.labelDefers(exe)
+	bg.labelInstrumentation(exe)
+
+	return bg
+}
+
+// markMorestack marks b and the blocks following it until the jump back
+// to the entry of the function as Morestack.
+func (bg *BlockGraph) markMorestack(b *Block, jumps map[int]int) {
+	for b != nil && !b.Morestack && b.ID != 0 {
+		b.Morestack = true
+		if destIdx, isjump := jumps[b.End-1]; isjump && destIdx == 0 {
+			return
+		}
+		var next *Block
+		for _, e := range b.Out {
+			if e.Kind == BlockFallthrough {
+				next = e.To
+			}
+		}
+		b = next
+	}
+}
+
+func (bg *BlockGraph) addEdge(from, to *Block, kind BlockEdgeKind) {
+	e := &BlockEdge{From: from, To: to, Kind: kind}
+	from.Out = append(from.Out, e)
+	to.In = append(to.In, e)
+}
+
+// endsPath returns true if execution never continues after inst.
+func endsPath(exe *Executable, inst AsmInstruction) bool {
+	switch inst.Inst.Op {
+	case x86asm.RET, x86asm.LRET, x86asm.UD1, x86asm.UD2:
+		return true
+	}
+	return isNoReturnCall(exe, inst)
+}
+
+// Reachable returns true if b can be reached from the entry block. Blocks
+// that are not reachable are padding or code following a return.
+func (bg *BlockGraph) Reachable(b *Block) bool {
+	return bg.reachable[b.ID]
+}
+
+// Stop is a place a debugger can stop at: a line and the inlined call it
+// belongs to, nil for the function itself.
+type Stop struct {
+	Pos     Pos
+	Inlined *InlinedCall
+}
+
+func (inst *AsmInstruction) Stop() Stop {
+	return Stop{inst.Pos, inst.Inlined}
+}
+
+// StopsIn returns, for each block, the stops a debugger could be stopped
+// at when execution enters the block. A debugger only stops at the start
+// of rows of the line table with is_stmt set, the line of the last stop is
+// what the user sees. Morestack blocks are not followed.
+func (bg *BlockGraph) StopsIn() [][]Stop {
+	in := make([][]Stop, len(bg.Blocks))
+	for changed := true; changed; {
+		changed = false
+		for _, b := range bg.Blocks {
+			if !bg.Reachable(b) || b.Morestack {
+				continue
+			}
+			out := in[b.ID]
+			if i := bg.lastStop(b); i >= 0 {
+				out = []Stop{bg.Text[i].Stop()}
+			}
+			for _, e := range b.Out {
+				for _, stop := range out {
+					if !containsStop(in[e.To.ID], stop) {
+						in[e.To.ID] = append(in[e.To.ID], stop)
+						changed = true
+					}
+				}
+			}
+		}
+	}
+	return in
+}
+
+func containsStop(v []Stop, stop Stop) bool {
+	for i := range v {
+		if v[i] == stop {
+			return true
+		}
+	}
+	return false
+}
+
+// lastStop returns the index of the last instruction of b with is_stmt
+// set, or -1. Helper sequences that are checked by acceptHelper instead of
+// as user code are skipped.
+func (bg *BlockGraph) lastStop(b *Block) int {
+	for i := b.End - 1; i >= b.Start; i-- {
+		switch bg.Text[i].Helper {
+		case HelperNone, HelperSpill, HelperRestore:
+			if bg.Text[i].IsStmt {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Index returns the index of the instruction at pc, or -1.
+func (bg *BlockGraph) Index(pc uint64) int {
+	if i, ok := bg.index[pc]; ok {
+		return i
+	}
+	return -1
+}
+
+// isTailCall returns true if inst jumps to a different function.
+func (bg *BlockGraph) isTailCall(inst AsmInstruction) bool {
+	if inst.Inst.Op != x86asm.JMP {
+		return false
+	}
+	imm, isimm := inst.Inst.Args[0].(x86asm.Imm)
+	return isimm && bg.Index(uint64(imm)) < 0
+}
+
+// jumpDest returns the index of the destination of the direct jump inst,
+// or -1 if inst is not a jump or jumps outside of the function.
+func (bg *BlockGraph) jumpDest(inst AsmInstruction) int {
+	switch inst.Inst.Op {
+	case x86asm.JA, x86asm.JAE, x86asm.JB, x86asm.JBE, x86asm.JCXZ, x86asm.JE, x86asm.JECXZ, x86asm.JG, x86asm.JGE, x86asm.JL, x86asm.JLE, x86asm.JNE, x86asm.JNO, x86asm.JNP, x86asm.JNS, x86asm.JO, x86asm.JP, x86asm.JRCXZ, x86asm.JS, x86asm.LOOPE, x86asm.LOOPNE, x86asm.LOOP:
+		//ok
+	case x86asm.JMP, x86asm.LJMP:
+		//ok
+	default:
+		return -1
+	}
+
+	imm, isimm := inst.Inst.Args[0].(x86asm.Imm)
+	if !isimm {
+		return -1
+	}
+
+	if i := bg.Index(uint64(imm)); i >= 0 {
+		return i
+	}
+
+	fmt.Fprintf(os.Stderr, "could not find destination of jump at %#x (destination pc %#x)\n", inst.Pc, imm)
+	return -1
+}
+
+func (k BlockEdgeKind) String() string {
+	switch k {
+	case BlockFallthrough:
+		return "fallthrough"
+	case BlockCond:
+		return "cond"
+	case BlockJump:
+		return "jump"
+	case BlockTable:
+		return "table"
+	}
+	return fmt.Sprintf("BlockEdgeKind(%d)", uint8(k))
+}
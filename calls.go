@@ -0,0 +1,122 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// addCallLines adds to s.Calls the lines of the function x that can
+// contain a call, either explicit or to a function of the runtime
+// inserted by the compiler (allocations, map accesses, conversions to
+// interfaces, write barriers, panics...).
+func (s *Successors) addCallLines(x *ast.FuncDecl) {
+	mark := func(n ast.Node) {
+		if n == nil {
+			return
+		}
+		start, end := s.ToPos(n.Pos()), s.ToPos(n.End())
+		for line := start.Line; line <= end.Line; line++ {
+			s.Calls[Pos{start.File, line}] = true
+		}
+	}
+	markPos := func(p token.Pos) {
+		s.Calls[s.ToPos(p)] = true
+	}
+
+	// stack check and deferreturn
+	markPos(x.Pos())
+	markPos(x.Body.Rbrace)
+
+	ast.Inspect(x.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr, *ast.CompositeLit, *ast.IndexExpr, *ast.IndexListExpr, *ast.SliceExpr, *ast.TypeAssertExpr:
+			mark(n)
+		case *ast.FuncLit:
+			// allocation of the closure
+			markPos(n.Type.Func)
+		case *ast.UnaryExpr:
+			if n.Op == token.AND || n.Op == token.ARROW {
+				mark(n)
+			}
+		case *ast.BinaryExpr:
+			switch n.Op {
+			case token.ADD, token.QUO, token.REM, token.SHL, token.SHR, token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+				// string concatenation and comparison, division by zero,
+				// negative shifts
+				mark(n)
+			}
+		case *ast.AssignStmt:
+			if assignCanCall(n) {
+				mark(n)
+			}
+		case *ast.DeclStmt, *ast.ReturnStmt, *ast.SendStmt, *ast.GoStmt, *ast.DeferStmt:
+			mark(n)
+		case *ast.RangeStmt:
+			markPos(n.For)
+			mark(n.X)
+		case *ast.SwitchStmt:
+			markPos(n.Switch)
+		case *ast.TypeSwitchStmt:
+			markPos(n.Switch)
+		case *ast.SelectStmt:
+			markPos(n.Select)
+		case *ast.CaseClause:
+			markPos(n.Case)
+		case *ast.CommClause:
+			markPos(n.Case)
+		}
+		return true
+	})
+}
+
+// assignCanCall returns false for assignments that only do arithmetic on
+// local variables.
+func assignCanCall(n *ast.AssignStmt) bool {
+	switch n.Tok {
+	case token.SUB_ASSIGN, token.MUL_ASSIGN, token.AND_ASSIGN, token.OR_ASSIGN, token.XOR_ASSIGN, token.AND_NOT_ASSIGN:
+		for _, lhs := range n.Lhs {
+			if _, isident := lhs.(*ast.Ident); !isident {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// checkCalls checks that every call of fn is attributed to a line that can
+// contain a call and that the return address of each call is on the same
+// line as the call, stack traces and profilers use the line of the return
+// address (minus one) to describe a frame. Calls inserted to instrument fn
+// can be on any line, they are checked by checkInstrumentation. The
+// return addresses of the atomic updates of coverage counters, which
+// belong to the block they count rather than to a statement, are not
+// checked.
+func checkCalls(fn *Function, bg *BlockGraph, exe *Executable, succs *Successors) int {
+	penalty := 0
+	for _, b := range bg.Blocks {
+		if !bg.Reachable(b) {
+			continue
+		}
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			if inst.Inst.Op != x86asm.CALL {
+				continue
+			}
+			if _, known := succs.G[inst.Pos]; known && !succs.Calls[inst.Pos] && !inst.Helper.Instrumentation() {
+				report(CatCallSite, inst.Pos, inst.Pc, "call on a line that does not contain calls")
+				penalty += CallSitePenalty
+			}
+			if isNoReturnCall(exe, inst) || inst.Helper == HelperCover || i+1 >= len(fn.Text) {
+				continue
+			}
+			if ret := fn.Text[i+1]; ret.Pos != inst.Pos {
+				report(CatCallSite, inst.Pos, inst.Pc, "return address is on %s:%d", ret.Pos.File, ret.Pos.Line)
+				penalty += ReturnAddressPenalty
+			}
+		}
+	}
+	return penalty
+}
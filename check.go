@@ -2,32 +2,81 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/arch/x86/x86asm"
 )
 
 const (
-	OutOfOrderPenalty    = 1   // moves to a different line but in the same group of lines
-	OutOfGroupPenalty    = 10  // moves to a different line, not in the group of lines we expected
-	OutOfFunctionPenalty = 100 // moves to a different line, in a different function?!
+	OutOfOrderPenalty      = 1   // moves to a different line but in the same group of lines
+	OutOfGroupPenalty      = 10  // moves to a different line, not in the group of lines we expected
+	OutOfFunctionPenalty   = 100 // moves to a different line, in a different function?!
+	MisattributionPenalty  = 10  // instruction attributed to a line that should not have any code
+	EntryPenalty           = 10  // breakpoint set on the function is misplaced
+	MorestackPenalty       = 1   // stack growth code attributed to the wrong line or containing stops
+	HelperPenalty          = 1   // compiler generated sequence attributed to the wrong line
+	CallSitePenalty        = 10  // call attributed to a line without calls
+	ReturnAddressPenalty   = 1   // return address of a call on a different line than the call
+	LoopPenalty            = 10  // header, back edge or exit of a loop attributed to the wrong line
+	DeferPenalty           = 10  // deferred call or panic recovery path attributed to the wrong line
+	StepPenalty            = 1   // stepping into or out of a call stops somewhere misleading
+	MultiplicityPenalty    = 1   // each unexpected stop of a breakpoint set on a line
+	ImpossiblePenalty      = 100 // instruction attributed to a blank, comment or out of function line
+	InstrumentationPenalty = 1   // race detector, sanitizer or coverage code attributed to the wrong line
+	PathPenalty            = 10  // sequence of lines that no path of the source visits
 )
 
+// Category is the kind of a problem found by check.
+type Category uint8
+
+const (
+	CatTransition      Category = iota // unexpected successor
+	CatMisattribution                  // instruction attributed to a line without code
+	CatUnbreakable                     // statement a debugger can not stop at
+	CatEntry                           // misplaced function entry breakpoint
+	CatMorestack                       // bad line information in stack growth code
+	CatHelper                          // bad line information in a helper sequence
+	CatCallSite                        // call attributed to the wrong line
+	CatUndecodable                     // bytes that could not be decoded
+	CatNoLine                          // instructions without line information
+	CatLineZero                        // instructions attributed to line 0
+	CatLoop                            // header, back edge or exit of a loop attributed to the wrong line
+	CatDefer                           // deferred call or panic recovery path attributed to the wrong line
+	CatStep                            // stepping into or out of a call stops somewhere misleading
+	CatMultiplicity                    // line with more stops than expected
+	CatImpossible                      // instruction attributed to a line that can never have code
+	CatInstrumentation                 // instrumentation attributed to the wrong line
+	CatPath                            // sequence of lines that no path of the source visits
+	CatNext                            // next command stopping at a line that is not a successor
+	numCategories
+)
+
+var categoryNames = [...]string{"transition", "misattribution", "unbreakable", "entry", "morestack", "helper", "call site", "undecodable", "no line", "line 0", "loop", "defer", "step", "multiplicity", "impossible line", "instrumentation", "path", "next"}
+
+func (c Category) String() string {
+	return categoryNames[c]
+}
+
+// Counts holds the number of problems found for each category.
+type Counts [numCategories]int
+
+var counts Counts
+
+// report prints a problem found at pc, attributed to pos.
+func report(cat Category, pos Pos, pc uint64, fmtstr string, args ...interface{}) {
+	counts[cat]++
+	printf(S|C, "%s:%d:%#x: %s\n", pos.File, pos.Line, pc, fmt.Sprintf(fmtstr, args...))
+}
+
 func check(fn *Function, succs *Successors, exe *Executable) int {
 	if fn.Decl == nil {
 		return 0
 	}
 	printf(C, "FUNCTION %s\n", fn.Name)
 
-	var curpos Pos
 	var penalty int
 
-	t := func(start, end Pos, pc uint64) {
-		penalty += succs.checkTransition(start, end, pc)
-		curpos = end
-	}
-
 	symlookup := func(pc uint64) (string, uint64) {
 		dest := exe.Gosym.PCToFunc(pc)
 		if dest == nil {
@@ -39,81 +88,216 @@ func check(fn *Function, succs *Successors, exe *Executable) int {
 		return dest.Name, dest.Entry
 	}
 
-	for _, inst := range fn.Text {
-		printf(C, "%s:%d\t%#x\t%s\n", filepath.Base(inst.Pos.File), inst.Pos.Line, inst.Pc, x86asm.GoSyntax(inst.Inst, inst.Pc, symlookup))
-		if curpos.File == "" && curpos.Line == 0 {
-			curpos = inst.Pos
+	bg := NewBlockGraph(fn.Text, exe)
+	in := bg.StopsIn()
+
+	for _, b := range bg.Blocks {
+		printf(C, "block %d:", b.ID)
+		for _, e := range b.In {
+			printf(C, " %d(%s)", e.From.ID, e.Kind)
 		}
+		printf(C, "\n")
 
-		/*
-			if inst.Inst.Op == x86asm.CALL {
-				// Any call to a function starting with runtime.panic does not return and
-				// can appear anywhere, so it shouldn't be considered a transition.
-				// TODO: actually check the destination of the call
-				curpos = Pos{"", -1}
+		// morestack blocks are checked by checkMorestack
+		reachable := bg.Reachable(b) && !b.Morestack
+		cur := in[b.ID]
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			printf(C, "%s:%d\t%#x\t%s%s\n", filepath.Base(inst.Pos.File), inst.Pos.Line, inst.Pc, x86asm.GoSyntax(inst.Inst, inst.Pc, symlookup), rowFlags(inst))
+			if !reachable {
+				// padding or code following a return
 				continue
-			}*/
+			}
 
-		if inst.Inst.Op == x86asm.UD1 || inst.Inst.Op == x86asm.UD2 {
-			// undefined instruction, assume we can never get here
-			curpos = Pos{"", -1}
-			continue
-		}
+			if succs.NoCode[inst.Pos] && (i == 0 || fn.Text[i-1].Pos != inst.Pos) {
+				report(CatMisattribution, inst.Pos, inst.Pc, "instruction on a line that only contains constants")
+				penalty += MisattributionPenalty
+			}
 
-		if curpos != inst.Pos {
-			t(curpos, inst.Pos, inst.Pc)
-		}
+			if inst.Inst.Op == x86asm.UD1 || inst.Inst.Op == x86asm.UD2 {
+				// undefined instruction, assume we can never get here
+				continue
+			}
 
-		if jmpdest, unconditional := isJump(fn, inst); jmpdest >= 0 {
-			if fn.Text[jmpdest].Pos != curpos {
-				penalty += succs.checkTransition(curpos, fn.Text[jmpdest].Pos, inst.Pc)
+			if inst.Helper != HelperNone {
+				if !bg.acceptHelper(exe, succs, b, i) {
+					if i == b.Start || fn.Text[i-1].Helper != inst.Helper || fn.Text[i-1].Pos != inst.Pos {
+						report(CatHelper, inst.Pos, inst.Pc, "%s attributed to the wrong line", inst.Helper)
+						penalty += HelperPenalty
+					}
+					continue
+				}
+				if inst.Helper != HelperSpill && inst.Helper != HelperRestore {
+					continue
+				}
 			}
-			if unconditional {
-				curpos = Pos{}
+
+			if !inst.IsStmt {
+				// a debugger never stops here
+				continue
 			}
+
+			penalty += succs.checkStep(fn.Graph, cur, inst.Stop(), inst.Pc)
+			cur = []Stop{inst.Stop()}
+		}
+		if !reachable {
+			continue
 		}
 
-		if isRet(fn, inst) {
-			t(curpos, Pos{"", -1}, inst.Pc)
+		last := fn.Text[b.End-1]
+		if isRet(fn, last) || bg.isTailCall(last) || (len(b.Out) == 0 && b.End == len(fn.Text) && !endsPath(exe, last)) {
+			penalty += succs.checkStep(fn.Graph, cur, Stop{Pos: Pos{"", -1}}, last.Pc)
 		}
 	}
 
-	if (curpos.File != "" || curpos.Line != 0) && len(fn.Text) > 0 {
-		t(curpos, Pos{"", -1}, fn.Text[len(fn.Text)-1].Pc)
-	}
+	checkStops(fn, succs)
+	penalty += checkEntry(fn, succs)
+	penalty += checkMorestack(fn, bg, succs)
+	penalty += checkCalls(fn, bg, exe, succs)
+	penalty += checkLoops(fn, bg, in, succs)
+	penalty += checkDefers(fn, bg, succs)
+	penalty += checkSteps(fn, bg, exe, succs)
+	penalty += checkMultiplicity(fn, bg, succs)
+	penalty += checkLines(fn, succs)
+	penalty += checkInstrumentation(fn, bg, succs)
+	penalty += checkPaths(fn, bg, succs)
+	checkChurn(fn, bg)
 
 	printf(C, "\n")
 
 	return penalty
 }
 
-func isJump(fn *Function, inst AsmInstruction) (destIdx int, unconditional bool) {
-	switch inst.Inst.Op {
-	case x86asm.JA, x86asm.JAE, x86asm.JB, x86asm.JBE, x86asm.JCXZ, x86asm.JE, x86asm.JECXZ, x86asm.JG, x86asm.JGE, x86asm.JL, x86asm.JLE, x86asm.JNE, x86asm.JNO, x86asm.JNP, x86asm.JNS, x86asm.JO, x86asm.JP, x86asm.JRCXZ, x86asm.JS, x86asm.LOOPE, x86asm.LOOPNE, x86asm.LOOP:
-		//ok
-	case x86asm.JMP, x86asm.LJMP:
-		unconditional = true
-	default:
-		return -1, false
+// rowFlags describes the flags of the line table row starting at inst and
+// the helper sequence it belongs to.
+func rowFlags(inst AsmInstruction) string {
+	r := ""
+	if inst.IsStmt {
+		r += " stmt"
 	}
-
-	if len(inst.Inst.Args) < 1 {
-		return -1, false
+	if inst.PrologueEnd {
+		r += " prologue_end"
+	}
+	if inst.EpilogueBegin {
+		r += " epilogue_begin"
 	}
+	if inst.Helper != HelperNone {
+		r += " [" + inst.Helper.String() + "]"
+	}
+	if r != "" {
+		r = "\t//" + r
+	}
+	return r
+}
 
-	imm, isimm := inst.Inst.Args[0].(x86asm.Imm)
-	if !isimm {
-		return -1, false
+// checkStops reports the statements of fn that a debugger can not stop
+// at, because none of their lines has a row with is_stmt set, then the
+// coverage of fn, which is added to coverage.
+func checkStops(fn *Function, succs *Successors) {
+	if fn.Graph == nil {
+		return
 	}
+	stops := map[Pos]bool{}
+	for _, inst := range fn.Text {
+		if inst.IsStmt {
+			stops[inst.Pos] = true
+		}
+	}
+	start, end := succs.ToPos(fn.Decl.Pos()), succs.ToPos(fn.Decl.End())
+	fncoverage := KindCoverage{}
+	for _, n := range fn.Graph.Nodes {
+		if (n.Kind != NodeStmt && n.Kind != NodeExpr) || len(n.Lines) == 0 {
+			continue
+		}
+		if first := n.Lines[0]; first.File != start.File || first.Line < start.Line || first.Line > end.Line {
+			// copied from an inlined function
+			continue
+		}
+		found := false
+		for _, pos := range n.Lines {
+			if stops[pos] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report(CatUnbreakable, n.Lines[0], fn.Start, "no is_stmt row for %s statement", stmtKind(n))
+		}
+		fncoverage.add(stmtKind(n), found)
+		coverage.add(stmtKind(n), found)
+	}
+	if c := fncoverage.Total(); c.Stops < c.Stmts {
+		printf(S|C, "%s: statements with stops %s, missing %s\n", fn.Name, c, fncoverage.Missing())
+	} else {
+		printf(C, "%s: statements with stops %s\n", fn.Name, c)
+	}
+}
+
+// checkLineInfo reports the undecodable regions of fn and the sequences
+// of instructions without line information or attributed to line 0, then
+// the number of each for fn. Padding is ignored. Unlike check it also
+// works on functions without source.
+func checkLineInfo(fn *Function) {
+	before := counts
+	defer func() {
+		fncounts := []string{}
+		for _, cat := range []Category{CatUndecodable, CatNoLine, CatLineZero} {
+			if n := counts[cat] - before[cat]; n > 0 {
+				fncounts = append(fncounts, fmt.Sprintf("%s %d", cat, n))
+			}
+		}
+		if len(fncounts) > 0 {
+			printf(S|C, "%s: %s\n", fn.Name, strings.Join(fncounts, ", "))
+		}
+	}()
 
-	for i := range fn.Text {
-		if fn.Text[i].Pc == uint64(imm) {
-			return i, unconditional
+	for i := 0; i < len(fn.Text); {
+		inst := fn.Text[i]
+		var cat Category
+		switch {
+		case inst.Padding:
+			i++
+			continue
+		case inst.Undecodable:
+			cat = CatUndecodable
+		case inst.Pos.File == "" && inst.Pos.Line == 0:
+			cat = CatNoLine
+		case inst.Pos.Line == 0:
+			cat = CatLineZero
+		default:
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(fn.Text) && !fn.Text[j].Padding && lineInfoCategory(fn.Text[j]) == cat {
+			j++
+		}
+		end := fn.End
+		if j < len(fn.Text) {
+			end = fn.Text[j].Pc
+		}
+		switch cat {
+		case CatUndecodable:
+			report(cat, inst.Pos, inst.Pc, "undecodable bytes %#x-%#x", inst.Pc, end)
+		case CatNoLine:
+			report(cat, inst.Pos, inst.Pc, "%d instructions without line information %#x-%#x", j-i, inst.Pc, end)
+		case CatLineZero:
+			report(cat, inst.Pos, inst.Pc, "%d instructions attributed to line 0 %#x-%#x", j-i, inst.Pc, end)
 		}
+		i = j
 	}
+}
 
-	fmt.Fprintf(os.Stderr, "could not find destination of jump at %#x (destination pc %#x)\n", inst.Pc, imm)
-	return -1, false
+func lineInfoCategory(inst AsmInstruction) Category {
+	switch {
+	case inst.Undecodable:
+		return CatUndecodable
+	case inst.Pos.File == "" && inst.Pos.Line == 0:
+		return CatNoLine
+	case inst.Pos.Line == 0:
+		return CatLineZero
+	}
+	return numCategories
 }
 
 func isRet(fn *Function, inst AsmInstruction) bool {
@@ -125,11 +309,170 @@ func isRet(fn *Function, inst AsmInstruction) bool {
 	}
 }
 
-func (s *Successors) checkTransition(start, end Pos, pc uint64) int {
+// NoReturn is the set of functions that never return to their caller.
+var NoReturn = map[string]bool{
+	"runtime.Goexit":                 true,
+	"runtime.fatal":                  true,
+	"runtime.fatalpanic":             true,
+	"runtime.fatalthrow":             true,
+	"runtime.gopanic":                true,
+	"runtime.panicBounds":            true,
+	"runtime.panicExtend":            true,
+	"runtime.panicIndex":             true,
+	"runtime.panicIndexU":            true,
+	"runtime.panicSliceAlen":         true,
+	"runtime.panicSliceAlenU":        true,
+	"runtime.panicSliceAcap":         true,
+	"runtime.panicSliceAcapU":        true,
+	"runtime.panicSliceB":            true,
+	"runtime.panicSliceBU":           true,
+	"runtime.panicSlice3Alen":        true,
+	"runtime.panicSlice3AlenU":       true,
+	"runtime.panicSlice3Acap":        true,
+	"runtime.panicSlice3AcapU":       true,
+	"runtime.panicSlice3B":           true,
+	"runtime.panicSlice3BU":          true,
+	"runtime.panicSlice3C":           true,
+	"runtime.panicSlice3CU":          true,
+	"runtime.panicSliceConvert":      true,
+	"runtime.panicdivide":            true,
+	"runtime.panicdottypeE":          true,
+	"runtime.panicdottypeI":          true,
+	"runtime.panicmem":               true,
+	"runtime.panicmemAddr":           true,
+	"runtime.panicnildottype":        true,
+	"runtime.panicoverflow":          true,
+	"runtime.panicrangestate":        true,
+	"runtime.panicshift":             true,
+	"runtime.panicunsafeslicelen":    true,
+	"runtime.panicunsafeslicenilptr": true,
+	"runtime.panicwrap":              true,
+	"runtime.throw":                  true,
+}
+
+// isNoReturnCall returns true if inst is a direct call to a function in
+// NoReturn.
+func isNoReturnCall(exe *Executable, inst AsmInstruction) bool {
+	if inst.Inst.Op != x86asm.CALL || len(inst.Inst.Args) < 1 || exe.Gosym == nil {
+		return false
+	}
+	imm, isimm := inst.Inst.Args[0].(x86asm.Imm)
+	if !isimm {
+		return false
+	}
+	dest := exe.Gosym.PCToFunc(uint64(imm))
+	if dest == nil || dest.Entry != uint64(imm) {
+		return false
+	}
+	return NoReturn[dest.Name]
+}
+
+// checkStep checks the transitions from each of the stops of from to to,
+// see steps, in the function with graph g. Stops on the same line, in
+// different inlined calls, can make up the same transitions, they are only
+// checked once.
+func (s *Successors) checkStep(g *Graph, from []Stop, to Stop, pc uint64) int {
+	penalty := 0
+	seen := map[[2]Pos]bool{}
+	for _, stop := range from {
+		for _, step := range steps(stop, to) {
+			if !seen[step] {
+				seen[step] = true
+				penalty += s.checkTransition(g, step[0], step[1], pc)
+			}
+		}
+	}
+	return penalty
+}
+
+// acceptStep returns true if checkStep would not report the transition
+// between from and to.
+func (s *Successors) acceptStep(g *Graph, from, to Stop) bool {
+	for _, step := range steps(from, to) {
+		if !s.acceptsIn(g, step[0], step[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// steps returns the transitions between lines that make up the
+// transition between two stops. If they belong to different inlined calls
+// the transition is checked inside each inlined function: the inlined
+// calls of from are left through their return, to their call site, and the
+// inlined calls of to are entered from their call site.
+func steps(from, to Stop) [][2]Pos {
+	common := commonInlined(from.Inlined, to.Inlined)
+	r := [][2]Pos{}
+	cur := from.Pos
+	for ic := from.Inlined; ic != common; ic = ic.Parent {
+		r = append(r, [2]Pos{cur, {"", -1}})
+		cur = ic.CallSite
+	}
+	enter := []*InlinedCall{}
+	for ic := to.Inlined; ic != common; ic = ic.Parent {
+		enter = append(enter, ic)
+	}
+	for i := len(enter) - 1; i >= 0; i-- {
+		if cur != enter[i].CallSite {
+			r = append(r, [2]Pos{cur, enter[i].CallSite})
+		}
+		cur = enter[i].CallSite
+	}
+	if cur != to.Pos {
+		r = append(r, [2]Pos{cur, to.Pos})
+	}
+	return r
+}
+
+// commonInlined returns the innermost inlined call containing both a and
+// b, nil if there is none.
+func commonInlined(a, b *InlinedCall) *InlinedCall {
+	for x := a; x != nil; x = x.Parent {
+		for y := b; y != nil; y = y.Parent {
+			if x == y {
+				return x
+			}
+		}
+	}
+	return nil
+}
+
+// accepts returns true if end is an acceptable successor of start.
+func (s *Successors) accepts(start, end Pos) bool {
 	if !acceptedFile(start.File) {
-		return 0
+		return true
 	}
-	if a := s.S[start]; a.Contains(end) || a.Any {
+	a := s.S[start]
+	return a.Contains(end) || a.Any
+}
+
+// acceptsIn returns true if end is an acceptable successor of start in
+// the function with graph g: the returns from the calls inlined in a
+// function continue after their call site, which depends on the caller,
+// they are only found in the graph of the caller.
+func (s *Successors) acceptsIn(g *Graph, start, end Pos) bool {
+	if s.accepts(start, end) {
+		return true
+	}
+	if g == nil {
+		return false
+	}
+	for _, n := range g.Nodes {
+		if !containsPos(n.Lines, start) {
+			continue
+		}
+		for _, e := range n.Out {
+			if e.Kind == EdgeInlineReturn && containsPos(e.To.Lines, end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Successors) checkTransition(g *Graph, start, end Pos, pc uint64) int {
+	if s.acceptsIn(g, start, end) {
 		return 0
 	}
 
@@ -140,7 +483,7 @@ func (s *Successors) checkTransition(start, end Pos, pc uint64) int {
 		return 0
 	}*/
 	
-	printf(S|C, "%s:%d:%#x: continues to %s:%d\n", start.File, start.Line, pc, end.File, end.Line)
+	report(CatTransition, start, pc, "continues to %s:%d", end.File, end.Line)
 	printf(C, "\texpected:\n")
 
 	penalty := OutOfFunctionPenalty
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckStep(t *testing.T) {
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	simpleOutput, complexOutput = devnull, devnull
+	defer func() { simpleOutput, complexOutput, counts = nil, nil, Counts{} }()
+
+	a, b, c := Pos{"a.go", 3}, Pos{"a.go", 4}, Pos{"b.go", 10}
+	ic1 := &InlinedCall{Name: "main.g", CallSite: b}
+	ic2 := &InlinedCall{Name: "main.g", CallSite: b}
+	s := Successors{S: map[Pos]PosSet{}}
+	s.addsucc(a, b)
+
+	for _, tc := range []struct {
+		name    string
+		from    []Stop
+		to      Stop
+		penalty int
+	}{
+		{"accepted", []Stop{{Pos: a}}, Stop{Pos: b}, 0},
+		{"one stop", []Stop{{Pos: b}}, Stop{Pos: a}, OutOfFunctionPenalty},
+		{"same line", []Stop{{Pos: b}, {Pos: b}}, Stop{Pos: a}, OutOfFunctionPenalty},
+		{"same inlined line", []Stop{{Pos: c, Inlined: ic1}, {Pos: c, Inlined: ic2}}, Stop{Pos: a}, OutOfGroupPenalty + OutOfFunctionPenalty},
+		{"different lines", []Stop{{Pos: b}, {Pos: c}}, Stop{Pos: a}, 2 * OutOfFunctionPenalty},
+	} {
+		if got := s.checkStep(nil, tc.from, tc.to, 0x1000); got != tc.penalty {
+			t.Errorf("%s: penalty %d, want %d", tc.name, got, tc.penalty)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BlockChurn is the number of line changes of a basic block in excess of
+// the minimum needed to visit all the distinct lines it stops at: a block
+// stopping at 10 11 10 11 12 has churn 2. Each change can be acceptable,
+// because the lines belong to the same group, but the user sees execution
+// going back and forth.
+// Stops in inlined calls count as stops on the line of the function
+// making the call: going back to the line of a call after executing it is
+// not churn.
+type BlockChurn struct {
+	Fn    string
+	Pc    uint64
+	Churn int
+	Lines []Pos // lines the block stops at, consecutive duplicates removed
+}
+
+// churns holds the blocks with churn found by check.
+var churns []BlockChurn
+
+// churn computes the churn of b.
+func (bg *BlockGraph) churn(b *Block) BlockChurn {
+	r := BlockChurn{Pc: bg.Text[b.Start].Pc}
+	distinct := []Pos{}
+	for i := b.Start; i < b.End; i++ {
+		inst := bg.Text[i]
+		if !inst.IsStmt || (inst.Helper != HelperNone && inst.Helper != HelperSpill && inst.Helper != HelperRestore) {
+			continue
+		}
+		pos := inst.Pos
+		for ic := inst.Inlined; ic != nil; ic = ic.Parent {
+			pos = ic.CallSite
+		}
+		if len(r.Lines) > 0 && r.Lines[len(r.Lines)-1] == pos {
+			continue
+		}
+		r.Lines = append(r.Lines, pos)
+		if !containsPos(distinct, pos) {
+			distinct = append(distinct, pos)
+		}
+	}
+	r.Churn = len(r.Lines) - len(distinct)
+	return r
+}
+
+// checkChurn records the blocks of fn with churn and returns the churn of
+// fn, the sum of the churn of its blocks.
+func checkChurn(fn *Function, bg *BlockGraph) int {
+	total := 0
+	for _, b := range bg.Blocks {
+		if !bg.Reachable(b) || b.Morestack {
+			continue
+		}
+		c := bg.churn(b)
+		if c.Churn == 0 {
+			continue
+		}
+		c.Fn = fn.Name
+		churns = append(churns, c)
+		total += c.Churn
+		printf(C, "churn %d at %#x: %s\n", c.Churn, c.Pc, c.String())
+	}
+	if total > 0 {
+		printf(C, "%s: churn %d\n", fn.Name, total)
+	}
+	return total
+}
+
+func (c *BlockChurn) String() string {
+	v := make([]string, len(c.Lines))
+	for i, pos := range c.Lines {
+		v[i] = fmt.Sprintf("%s:%d", filepath.Base(pos.File), pos.Line)
+	}
+	return strings.Join(v, " ")
+}
+
+// worstChurn returns the n blocks with the most churn.
+func worstChurn(n int) []BlockChurn {
+	r := make([]BlockChurn, len(churns))
+	copy(r, churns)
+	sort.SliceStable(r, func(i, j int) bool { return r[i].Churn > r[j].Churn })
+	if len(r) > n {
+		r = r[:n]
+	}
+	return r
+}
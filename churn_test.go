@@ -0,0 +1,55 @@
+package main
+
+import (
+	"debug/gosym"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+func TestChurn(t *testing.T) {
+	call := &InlinedCall{Name: "main.g", CallSite: Pos{"a.go", 11}}
+	for _, tc := range []struct {
+		name  string
+		text  []AsmInstruction
+		churn int
+	}{
+		{"sequential", []AsmInstruction{
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+			{Pos: Pos{"a.go", 11}, IsStmt: true},
+			{Pos: Pos{"a.go", 12}, IsStmt: true},
+		}, 0},
+		{"back and forth", []AsmInstruction{
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+			{Pos: Pos{"a.go", 11}, IsStmt: true},
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+			{Pos: Pos{"a.go", 11}, IsStmt: true},
+			{Pos: Pos{"a.go", 12}, IsStmt: true},
+		}, 2},
+		{"not statements", []AsmInstruction{
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+			{Pos: Pos{"a.go", 11}},
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+		}, 0},
+		{"inlined call", []AsmInstruction{
+			{Pos: Pos{"a.go", 11}, IsStmt: true},
+			{Pos: Pos{"b.go", 3}, IsStmt: true, Inlined: call},
+			{Pos: Pos{"b.go", 4}, IsStmt: true, Inlined: call},
+			{Pos: Pos{"a.go", 11}, IsStmt: true},
+		}, 0},
+		{"helper", []AsmInstruction{
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+			{Pos: Pos{"a.go", 11}, IsStmt: true, Helper: HelperWriteBarrier},
+			{Pos: Pos{"a.go", 10}, IsStmt: true},
+		}, 0},
+	} {
+		for i := range tc.text {
+			tc.text[i].Inst = x86asm.Inst{Op: x86asm.MOV}
+			tc.text[i].Pc = 0x1000 + uint64(i)
+		}
+		bg := NewBlockGraph(tc.text, &Executable{Gosym: &gosym.Table{}})
+		if c := bg.churn(bg.Blocks[0]); c.Churn != tc.churn {
+			t.Errorf("%s: churn %d (%s), want %d", tc.name, c.Churn, c.String(), tc.churn)
+		}
+	}
+}
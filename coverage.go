@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"sort"
+	"strings"
+)
+
+// Coverage counts the statements a debugger can stop at.
+type Coverage struct {
+	Stmts int // statements
+	Stops int // statements with at least one stop
+}
+
+func (c *Coverage) add(stop bool) {
+	c.Stmts++
+	if stop {
+		c.Stops++
+	}
+}
+
+// Percent returns the percentage of statements with a stop.
+func (c Coverage) Percent() float64 {
+	if c.Stmts == 0 {
+		return 100
+	}
+	return 100 * float64(c.Stops) / float64(c.Stmts)
+}
+
+func (c Coverage) String() string {
+	return fmt.Sprintf("%d/%d %.1f%%", c.Stops, c.Stmts, c.Percent())
+}
+
+// KindCoverage is the Coverage of each kind of statement.
+type KindCoverage map[string]*Coverage
+
+func (kc KindCoverage) add(kind string, stop bool) {
+	if kc[kind] == nil {
+		kc[kind] = &Coverage{}
+	}
+	kc[kind].add(stop)
+}
+
+// Total returns the Coverage of all kinds together.
+func (kc KindCoverage) Total() Coverage {
+	var r Coverage
+	for _, c := range kc {
+		r.Stmts += c.Stmts
+		r.Stops += c.Stops
+	}
+	return r
+}
+
+// Missing describes the kinds of the statements without a stop.
+func (kc KindCoverage) Missing() string {
+	v := []string{}
+	for _, kind := range kc.kinds() {
+		if c := kc[kind]; c.Stops < c.Stmts {
+			v = append(v, fmt.Sprintf("%s %d", kind, c.Stmts-c.Stops))
+		}
+	}
+	return strings.Join(v, ", ")
+}
+
+func (kc KindCoverage) kinds() []string {
+	r := make([]string, 0, len(kc))
+	for kind := range kc {
+		r = append(r, kind)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// coverage holds the coverage of all the functions checked.
+var coverage = KindCoverage{}
+
+// stmtKind returns the kind of the statement of n, a node of the source
+// graph: the name of its AST node without the Stmt suffix, for example
+// "assign" or "range". Loop headers have the kind of their statement, the
+// conditions of if statements are "if" and the elements of composite
+// literals spanning multiple lines "element".
+func stmtKind(n *Node) string {
+	if n.Kind == NodeExpr {
+		if _, ok := n.AST.(ast.Expr); ok {
+			return "if"
+		}
+		if n.AnyOrder {
+			return "element"
+		}
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", n.AST), "*ast.")
+	return strings.ToLower(strings.TrimSuffix(name, "Stmt"))
+}
+
+// printCoverage prints the coverage of each kind of statement and of all
+// statements.
+func printCoverage(kc KindCoverage) {
+	for _, kind := range kc.kinds() {
+		printf(S|C, "\t%s: %s\n", kind, kc[kind])
+	}
+	printf(S|C, "\ttotal: %s\n", kc.Total())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const coverageSrc = `package main
+
+func f(s []int) int {
+	n := 0
+	for _, x := range s {
+		if x > 0 {
+			n += x
+		}
+	}
+	v := []int{
+		n,
+		n + 1,
+	}
+	return v[1]
+}
+`
+
+func TestCoverage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coverage.go")
+	if err := os.WriteFile(path, []byte(coverageSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	funcs := []Function{{Name: "main.f"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	fn := &funcs[0]
+	if fn.Graph == nil {
+		t.Fatal("no graph for main.f")
+	}
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	simpleOutput, complexOutput = devnull, devnull
+	defer func() { simpleOutput, complexOutput, counts, coverage = nil, nil, Counts{}, KindCoverage{} }()
+
+	coverage = KindCoverage{}
+	for _, l := range []int{4, 5, 6, 10, 11} {
+		fn.Text = append(fn.Text, AsmInstruction{Pc: 0x1000 + uint64(l), Pos: Pos{path, l}, IsStmt: true})
+	}
+	checkStops(fn, &s)
+
+	want := KindCoverage{
+		"assign":  {Stmts: 3, Stops: 2},
+		"range":   {Stmts: 1, Stops: 1},
+		"if":      {Stmts: 1, Stops: 1}, // the condition
+		"element": {Stmts: 2, Stops: 1},
+		"return":  {Stmts: 1, Stops: 0},
+	}
+	if !reflect.DeepEqual(coverage, want) {
+		for kind, c := range coverage {
+			t.Logf("%s: %s", kind, c)
+		}
+		t.Errorf("coverage by kind differs")
+	}
+	if got := coverage.Total(); got != (Coverage{Stmts: 8, Stops: 5}) {
+		t.Errorf("total %s, want 5/8", got)
+	}
+	if got, want := coverage.Missing(), "assign 1, element 1, return 1"; got != want {
+		t.Errorf("missing %q, want %q", got, want)
+	}
+}
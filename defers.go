@@ -0,0 +1,253 @@
+package main
+
+import (
+	"go/ast"
+	"math/bits"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// stackByte returns the byte of the stack written by inst, if inst
+// writes a single byte of the stack.
+func stackByte(inst x86asm.Inst) (x86asm.Mem, bool) {
+	switch inst.Op {
+	case x86asm.MOV, x86asm.OR, x86asm.AND:
+	default:
+		return x86asm.Mem{}, false
+	}
+	mem, ok := inst.Args[0].(x86asm.Mem)
+	if !ok || inst.MemBytes != 1 || (mem.Base != x86asm.RSP && mem.Base != x86asm.RBP) {
+		return x86asm.Mem{}, false
+	}
+	return mem, true
+}
+
+func immArg(inst x86asm.Inst) (uint8, bool) {
+	imm, ok := inst.Args[1].(x86asm.Imm)
+	return uint8(imm), ok
+}
+
+// isRegLoad returns true if inst loads a register without side effects.
+func isRegLoad(inst x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.MOV, x86asm.LEA:
+		return isRegArg(inst.Args[0])
+	}
+	return false
+}
+
+// labelDefers labels the open-coded calls of deferred functions as
+// HelperDefer and the blocks calling runtime.deferreturn that execution
+// can only reach when recovering from a panic as HelperDeferreturn.
+//
+// Each defer statement sets a bit of a bitmask on the stack, when the
+// function returns the deferred functions of the bits that are set are
+// called in reverse order, after clearing their bit:
+//
+//	[TESTB $0x2, 0x6(SP); JE next]		[TESTL $0x2, BL; JE next]
+//	ANDB $0xfd, 0x6(SP)		or	ANDL $-0x3, BX; MOVB BL, 0x6(SP)
+//	MOVQ 0x48(SP), DX; MOVQ 0(DX), AX
+//	CALL AX
+//
+// the test is omitted for defer statements that are always executed and
+// the bitmask can be cleared with a single MOVB. Such a MOVB is generated
+// on the line of the call, the MOVB setting the bit of a defer statement
+// followed by a call is on a different line. The deferred function is
+// always loaded from the stack, where the runtime finds it when running
+// the deferred calls during a panic.
+// Only functions calling runtime.deferreturn, which all functions with
+// open-coded defers do, are considered.
+func (bg *BlockGraph) labelDefers(exe *Executable) {
+	text := bg.Text
+	hasDeferreturn := false
+	registered := map[x86asm.Mem]bool{}
+	for _, inst := range text {
+		if name, _, _ := callTarget(exe, inst); name == "runtime.deferreturn" {
+			hasDeferreturn = true
+		}
+		mem, ok := stackByte(inst.Inst)
+		imm, isimm := immArg(inst.Inst)
+		if ok && isimm && (inst.Inst.Op == x86asm.OR || (inst.Inst.Op == x86asm.MOV && imm != 0)) {
+			registered[mem] = true
+		}
+	}
+	if !hasDeferreturn {
+		return
+	}
+
+	for _, b := range bg.Blocks {
+		for i := b.Start; i < b.End; i++ {
+			if text[i].Inst.Op != x86asm.CALL {
+				continue
+			}
+			if name, _, _ := callTarget(exe, text[i]); name == "runtime.deferreturn" {
+				if !bg.Reachable(b) {
+					bg.labelBlock(b, HelperDeferreturn)
+				}
+				continue
+			}
+			j := bg.deferUpdate(b, i)
+			if j < 0 {
+				continue
+			}
+			isdefer := false
+			for k := j; k < i; k++ {
+				if mem, ok := stackByte(text[k].Inst); ok && registered[mem] {
+					isdefer = true
+				}
+			}
+			if _, isimm := immArg(text[j].Inst); isimm && text[j].Inst.Op == x86asm.MOV && text[j].Pos != text[i].Pos {
+				// defer statement followed by a call
+				isdefer = false
+			}
+			if isdefer && bg.calleeFromStack(j, i) {
+				for k := j; k <= i; k++ {
+					text[k].Helper = HelperDefer
+				}
+			}
+		}
+	}
+}
+
+// deferUpdate returns the index of the first instruction of the update of
+// the bitmask of open-coded defers preceding the call at index i, part of
+// b, or -1.
+func (bg *BlockGraph) deferUpdate(b *Block, i int) int {
+	j := i - 1
+	for j >= b.Start && isRegLoad(bg.Text[j].Inst) {
+		j--
+	}
+	start := -1
+	for ; j >= b.Start; j-- {
+		inst := bg.Text[j].Inst
+		if _, ok := stackByte(inst); ok {
+			start = j
+			continue
+		}
+		if _, isimm := immArg(inst); inst.Op == x86asm.AND && isimm && start >= 0 {
+			start = j
+		}
+		break
+	}
+	return start
+}
+
+// calleeFromStack returns true if the call at index i calls a function
+// directly or through a register loaded from the stack by the instructions
+// starting at index j.
+func (bg *BlockGraph) calleeFromStack(j, i int) bool {
+	reg, ok := bg.Text[i].Inst.Args[0].(x86asm.Reg)
+	if !ok {
+		_, isimm := bg.Text[i].Inst.Args[0].(x86asm.Imm)
+		return isimm
+	}
+	for k := i - 1; k >= j; k-- {
+		inst := bg.Text[k].Inst
+		if inst.Op != x86asm.MOV || inst.Args[0] != reg {
+			continue
+		}
+		mem, ismem := inst.Args[1].(x86asm.Mem)
+		switch {
+		case !ismem:
+			return false
+		case mem.Base == x86asm.RSP || mem.Base == x86asm.RBP:
+			return true
+		}
+		// load of the code pointer from the closure
+		reg = mem.Base
+	}
+	return false
+}
+
+// deferIndex returns the bit of the bitmask of open-coded defers, that is
+// the index of the defer statement in the function, of the deferred call
+// at index i, part of b, or -1. The bit is taken from the test guarding
+// the call if there is one, otherwise from the update of the bitmask: bits
+// are cleared starting from the last one.
+func (bg *BlockGraph) deferIndex(b *Block, i int) int {
+	start := bg.deferUpdate(b, i)
+	if start == b.Start && len(b.In) == 1 {
+		from := b.In[0].From
+		if from.End-2 >= from.Start {
+			guard := bg.Text[from.End-2].Inst
+			if imm, isimm := immArg(guard); isimm {
+				switch guard.Op {
+				case x86asm.TEST:
+					return bits.TrailingZeros8(imm)
+				case x86asm.BT:
+					return int(imm)
+				}
+			}
+		}
+	}
+	for j := start; j < i; j++ {
+		inst := bg.Text[j].Inst
+		imm, isimm := immArg(inst)
+		switch {
+		case !isimm:
+			// register stored to the bitmask
+		case inst.Op == x86asm.AND:
+			return bits.TrailingZeros8(^imm)
+		case inst.Op == x86asm.MOV:
+			return bits.Len8(imm)
+		}
+	}
+	return -1
+}
+
+// deferStmts returns the defer statements of x, in the order they appear.
+func deferStmts(x *ast.FuncDecl) []*ast.DeferStmt {
+	r := []*ast.DeferStmt{}
+	ast.Inspect(x.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.DeferStmt:
+			r = append(r, n)
+		}
+		return true
+	})
+	return r
+}
+
+// checkDefers checks the exit paths of functions with defer statements.
+// Each open-coded call of a deferred function must be attributed to the
+// line of its defer statement, the code that runs the deferred calls when
+// recovering from a panic to the closing brace of the function.
+func checkDefers(fn *Function, bg *BlockGraph, succs *Successors) int {
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok {
+		return 0
+	}
+	defers := deferStmts(x)
+	rbrace := succs.ToPos(x.Body.Rbrace)
+	penalty := 0
+	for _, b := range bg.Blocks {
+		recovery := false
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			switch {
+			case inst.Helper == HelperDefer && inst.Inst.Op == x86asm.CALL:
+				k := bg.deferIndex(b, i)
+				if k < 0 || k >= len(defers) {
+					report(CatDefer, inst.Pos, inst.Pc, "deferred call does not match any defer statement")
+					penalty += DeferPenalty
+					continue
+				}
+				want := succs.ToPos(defers[k].Pos())
+				printf(C, "deferred call %#x: %s:%d\n", inst.Pc, want.File, want.Line)
+				if inst.Pos != want {
+					report(CatDefer, inst.Pos, inst.Pc, "call of the function deferred at line %d attributed to a different line", want.Line)
+					penalty += DeferPenalty
+				}
+			case inst.Helper == HelperDeferreturn && (inst.IsStmt || inst.Inst.Op == x86asm.CALL):
+				if inst.Pos != rbrace && !recovery {
+					recovery = true
+					report(CatDefer, inst.Pos, inst.Pc, "panic recovery path is not attributed to the closing brace of %s", fn.Name)
+					penalty += DeferPenalty
+				}
+			}
+		}
+	}
+	return penalty
+}
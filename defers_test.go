@@ -0,0 +1,119 @@
+package main
+
+import (
+	"debug/gosym"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+const defersSrc = `package main
+
+func f(a, b func()) {
+	defer a()
+	g()
+	if b != nil {
+		defer b()
+	}
+}
+`
+
+func TestDefers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defers.go")
+	if err := os.WriteFile(path, []byte(defersSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	funcs := []Function{{Name: "main.f"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	fn := &funcs[0]
+	if fn.Decl == nil {
+		t.Fatal("no declaration for main.f")
+	}
+	exe := &Executable{Gosym: &gosym.Table{Funcs: []gosym.Func{
+		{Entry: 0x2000, End: 0x2100, Sym: &gosym.Sym{Name: "runtime.deferreturn"}},
+		{Entry: 0x2100, End: 0x2200, Sym: &gosym.Sym{Name: "main.g"}},
+	}}}
+
+	bitmask := x86asm.Mem{Base: x86asm.RSP, Disp: 0x6}
+	slot := func(disp int64) x86asm.Mem { return x86asm.Mem{Base: x86asm.RSP, Disp: disp} }
+	inst := func(line int, stmt bool, op x86asm.Op, args ...x86asm.Arg) AsmInstruction {
+		r := AsmInstruction{Inst: x86asm.Inst{Op: op}, Pos: Pos{path, line}, IsStmt: stmt}
+		copy(r.Inst.Args[:], args)
+		if len(args) > 0 && args[0] == bitmask {
+			r.Inst.MemBytes = 1
+		}
+		return r
+	}
+	text := func() []AsmInstruction {
+		return []AsmInstruction{
+			inst(4, true, x86asm.MOV, slot(0x48), x86asm.RAX),
+			inst(4, false, x86asm.MOV, bitmask, x86asm.Imm(1)),
+			inst(5, true, x86asm.CALL, x86asm.Imm(0x2100)), // not a deferred call
+			inst(6, true, x86asm.TEST, x86asm.RBX, x86asm.RBX),
+			inst(6, false, x86asm.JE, x86asm.Imm(0x1008)),
+			inst(7, true, x86asm.MOV, slot(0x50), x86asm.RBX),
+			inst(7, false, x86asm.OR, bitmask, x86asm.Imm(2)),
+			inst(9, true, x86asm.NOP),
+			// deferred call of b, guarded by a test of its bit
+			inst(9, false, x86asm.TEST, bitmask, x86asm.Imm(2)),
+			inst(9, false, x86asm.JE, x86asm.Imm(0x100e)),
+			inst(7, true, x86asm.AND, bitmask, x86asm.Imm(0xfd)),
+			inst(7, false, x86asm.MOV, x86asm.RDX, slot(0x50)),
+			inst(7, false, x86asm.MOV, x86asm.RAX, x86asm.Mem{Base: x86asm.RDX}),
+			inst(7, false, x86asm.CALL, x86asm.RAX),
+			// deferred call of a, always executed
+			inst(4, true, x86asm.MOV, bitmask, x86asm.Imm(0)),
+			inst(4, false, x86asm.MOV, x86asm.RDX, slot(0x48)),
+			inst(4, false, x86asm.MOV, x86asm.RAX, x86asm.Mem{Base: x86asm.RDX}),
+			inst(4, false, x86asm.CALL, x86asm.RAX),
+			inst(9, true, x86asm.RET),
+			// only reached when recovering from a panic
+			inst(9, true, x86asm.CALL, x86asm.Imm(0x2000)),
+			inst(9, false, x86asm.RET),
+		}
+	}
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	simpleOutput, complexOutput = devnull, devnull
+	defer func() { simpleOutput, complexOutput, counts = nil, nil, Counts{} }()
+
+	for _, tc := range []struct {
+		name    string
+		change  func(text []AsmInstruction)
+		penalty int
+	}{
+		{"correct", func([]AsmInstruction) {}, 0},
+		{"guarded call on the wrong line", func(text []AsmInstruction) { text[13].Pos.Line = 4 }, DeferPenalty},
+		// the MOVB clearing the bitmask is on the line of the call
+		{"last call on the wrong line", func(text []AsmInstruction) { text[14].Pos.Line, text[17].Pos.Line = 9, 9 }, DeferPenalty},
+		{"recovery on the wrong line", func(text []AsmInstruction) { text[19].Pos.Line = 5 }, DeferPenalty},
+	} {
+		text := text()
+		for i := range text {
+			text[i].Pc = 0x1000 + uint64(i)
+		}
+		tc.change(text)
+		fn.Text = text
+		bg := NewBlockGraph(text, exe)
+		for i, want := range map[int]HelperKind{1: HelperNone, 2: HelperNone, 10: HelperDefer, 13: HelperDefer, 14: HelperDefer, 17: HelperDefer, 19: HelperDeferreturn} {
+			if bg.Text[i].Helper != want {
+				t.Errorf("%s: instruction %d labeled %q, want %q", tc.name, i, bg.Text[i].Helper, want)
+			}
+		}
+		for i, want := range map[int]int{13: 1, 17: 0} {
+			if k := bg.deferIndex(bg.blockOf(i), i); k != want {
+				t.Errorf("%s: call %d matched to defer statement %d, want %d", tc.name, i, k, want)
+			}
+		}
+		if penalty := checkDefers(fn, bg, &s); penalty != tc.penalty {
+			t.Errorf("%s: penalty %d, want %d", tc.name, penalty, tc.penalty)
+		}
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"debug/dwarf"
+	"encoding/binary"
 	"go/ast"
 	"regexp"
 	"strings"
-	"sort"
 
 	"golang.org/x/arch/x86/x86asm"
 )
@@ -16,12 +16,35 @@ type Function struct {
 	Start, End  uint64
 	Text        []AsmInstruction
 	Decl        ast.Decl
+	Graph       *Graph
+	Inlined     []*InlinedCall // all calls inlined in the function, outer calls first
+}
+
+// InlinedCall is a call that was inlined, as described by a
+// DW_TAG_inlined_subroutine entry.
+type InlinedCall struct {
+	Name     string      // name of the inlined function
+	CallSite Pos         // position of the call
+	Ranges   [][2]uint64 // addresses of the inlined body
+	Parent   *InlinedCall
 }
 
 type AsmInstruction struct {
-	Inst x86asm.Inst
-	Pc   uint64
-	Pos  Pos
+	Inst      x86asm.Inst
+	Pc        uint64
+	Pos       Pos
+	JumpTable []uint64   // destinations of an indirect jump through a jump table
+	Helper    HelperKind   // set by NewBlockGraph for compiler generated sequences
+	Inlined   *InlinedCall // innermost inlined call containing the instruction, nil if it belongs to the function itself
+
+	Undecodable bool // a byte that could not be decoded
+	Padding     bool // INT3 or NOPs used to align functions, never executed
+
+	// flags of the line table row starting at this instruction, always
+	// false for instructions in the middle of a row
+	IsStmt        bool // a debugger can stop here
+	PrologueEnd   bool
+	EpilogueBegin bool
 }
 
 func (exe *Executable) FunctionsMatching(pattern string) []Function {
@@ -46,25 +69,196 @@ func (exe *Executable) FunctionsMatching(pattern string) []Function {
 			must(err)
 		case dwarf.TagSubprogram:
 			name, okname := entry.Val(dwarf.AttrName).(string)
-			if !okname || !re.MatchString(name) {
+			_, okstart := entry.Val(dwarf.AttrLowpc).(uint64)
+			if !okname || !okstart || !re.MatchString(name) {
+				// abstract subprograms, used by inlined calls, have no code
+				rdr.SkipChildren()
 				continue
 			}
 			if strings.HasSuffix(name, ".init") || strings.Index(name, ".init.") >= 0 {
+				rdr.SkipChildren()
 				continue
 			}
-			start := entry.Val(dwarf.AttrLowpc).(uint64)
-			end := entry.Val(dwarf.AttrHighpc).(uint64)
-			r = append(r, Function{
-				Name:        name,
-				CompileUnit: cu,
-				Start:       start,
-				End:         end,
-				Text:        exe.disassemble(start, end, lnrdr),
-			})
+			r = append(r, *exe.newFunction(rdr, cu, entry, lnrdr))
 		}
 	}
 }
 
+// newFunction disassembles the function described by entry, the last
+// entry read from rdr, and reads its inlined calls.
+func (exe *Executable) newFunction(rdr *dwarf.Reader, cu, entry *dwarf.Entry, lnrdr *dwarf.LineReader) *Function {
+	name, ok := entry.Val(dwarf.AttrName).(string)
+	if !ok {
+		// out of line copy of an inlined function
+		name = exe.abstractOriginName(entry)
+	}
+	start, _ := entry.Val(dwarf.AttrLowpc).(uint64)
+	end := highpc(entry, start)
+	fn := &Function{
+		Name:        name,
+		CompileUnit: cu,
+		Start:       start,
+		End:         end,
+		Text:        exe.disassemble(start, end, lnrdr),
+	}
+	if entry.Children {
+		fn.Inlined = exe.readInlined(rdr, lnrdr.Files(), nil, nil)
+		fn.setInlined()
+	}
+	return fn
+}
+
+// FunctionAt returns the function with entry point pc, nil if there is no
+// debug information for it. Results are cached.
+func (exe *Executable) FunctionAt(pc uint64) *Function {
+	if fn, cached := exe.functions[pc]; cached {
+		return fn
+	}
+	if exe.functions == nil {
+		exe.functions = make(map[uint64]*Function)
+	}
+	exe.functions[pc] = nil
+
+	if exe.subprograms == nil {
+		exe.readSubprograms()
+	}
+	off, ok := exe.subprograms[pc]
+	if !ok {
+		return nil
+	}
+	rdr := exe.Data.Reader()
+	rdr.Seek(off[0])
+	cu, err := rdr.Next()
+	must(err)
+	lnrdr, err := exe.Data.LineReader(cu)
+	must(err)
+	rdr.Seek(off[1])
+	entry, err := rdr.Next()
+	must(err)
+	fn := exe.newFunction(rdr, cu, entry, lnrdr)
+	exe.functions[pc] = fn
+	return fn
+}
+
+// readSubprograms fills exe.subprograms with the offsets of the compile
+// unit and of the entry of each function with code.
+func (exe *Executable) readSubprograms() {
+	exe.subprograms = make(map[uint64][2]dwarf.Offset)
+	var cu dwarf.Offset
+	rdr := exe.Data.Reader()
+	for {
+		entry, err := rdr.Next()
+		must(err)
+		if entry == nil {
+			return
+		}
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			cu = entry.Offset
+		case dwarf.TagSubprogram:
+			if start, ok := entry.Val(dwarf.AttrLowpc).(uint64); ok {
+				exe.subprograms[start] = [2]dwarf.Offset{cu, entry.Offset}
+			}
+			rdr.SkipChildren()
+		}
+	}
+}
+
+// setInlined sets the Inlined field of each instruction of fn.
+func (fn *Function) setInlined() {
+	for i := range fn.Text {
+		inst := &fn.Text[i]
+		// inner calls come after the calls containing them
+		for _, ic := range fn.Inlined {
+			if ic.Contains(inst.Pc) {
+				inst.Inlined = ic
+			}
+		}
+	}
+}
+
+// Contains returns true if pc is part of the inlined body of ic.
+func (ic *InlinedCall) Contains(pc uint64) bool {
+	for _, rng := range ic.Ranges {
+		if pc >= rng[0] && pc < rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// highpc returns the end address of entry, DW_AT_high_pc can be either an
+// address or an offset from DW_AT_low_pc.
+func highpc(entry *dwarf.Entry, lowpc uint64) uint64 {
+	switch v := entry.Val(dwarf.AttrHighpc).(type) {
+	case uint64:
+		return v
+	case int64:
+		return lowpc + uint64(v)
+	}
+	return lowpc
+}
+
+// readInlined reads the children of a subprogram or inlined subroutine
+// and appends all inlined calls found to r, in pre-order.
+func (exe *Executable) readInlined(rdr *dwarf.Reader, files []*dwarf.LineFile, parent *InlinedCall, r []*InlinedCall) []*InlinedCall {
+	for {
+		entry, err := rdr.Next()
+		must(err)
+		if entry == nil || entry.Tag == 0 {
+			return r
+		}
+
+		switch entry.Tag {
+		case dwarf.TagInlinedSubroutine:
+			ic := &InlinedCall{Name: exe.abstractOriginName(entry), Parent: parent}
+			if idx, ok := entry.Val(dwarf.AttrCallFile).(int64); ok && idx >= 0 && int(idx) < len(files) && files[idx] != nil {
+				ic.CallSite.File = files[idx].Name
+			}
+			if line, ok := entry.Val(dwarf.AttrCallLine).(int64); ok {
+				ic.CallSite.Line = int(line)
+			}
+			ic.Ranges, err = exe.Data.Ranges(entry)
+			must(err)
+			r = append(r, ic)
+			if entry.Children {
+				r = exe.readInlined(rdr, files, ic, r)
+			}
+		case dwarf.TagLexDwarfBlock:
+			if entry.Children {
+				r = exe.readInlined(rdr, files, parent, r)
+			}
+		default:
+			if entry.Children {
+				rdr.SkipChildren()
+			}
+		}
+	}
+}
+
+func (exe *Executable) abstractOriginName(entry *dwarf.Entry) string {
+	off, ok := entry.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+	if !ok {
+		return ""
+	}
+	if name, cached := exe.abstractOrigins[off]; cached {
+		return name
+	}
+	rdr := exe.Data.Reader()
+	rdr.Seek(off)
+	origin, err := rdr.Next()
+	must(err)
+	name := ""
+	if origin != nil {
+		name, _ = origin.Val(dwarf.AttrName).(string)
+	}
+	if exe.abstractOrigins == nil {
+		exe.abstractOrigins = make(map[dwarf.Offset]string)
+	}
+	exe.abstractOrigins[off] = name
+	return name
+}
+
 func (exe *Executable) disassemble(start, end uint64, lnrdr *dwarf.LineReader) []AsmInstruction {
 	var lne dwarf.LineEntry
 	mem := exe.Text[start-exe.TextStart : end-exe.TextStart]
@@ -77,15 +271,19 @@ func (exe *Executable) disassemble(start, end uint64, lnrdr *dwarf.LineReader) [
 		inst, err := x86asm.Decode(mem, 64)
 		if err == nil {
 			var pos Pos
+			rowStart := false
 			for lnevalid && lne.Address < pc {
 				err := lnrdr.Next(&lne)
 				lnevalid = err == nil
 			}
 			if lnevalid {
-				if lne.Address == pc {
-					pos.File = lne.File.Name
+				if lne.Address == pc && !lne.EndSequence {
+					if lne.File != nil {
+						pos.File = lne.File.Name
+					}
 					pos.Line = lne.Line
-				} else {
+					rowStart = true
+				} else if lne.Address > pc {
 					pos = prevPos
 				}
 			}
@@ -93,15 +291,118 @@ func (exe *Executable) disassemble(start, end uint64, lnrdr *dwarf.LineReader) [
 			
 			patchPCRel(pc, &inst)
 
-			r = append(r, AsmInstruction{inst, pc, pos})
+			r = append(r, AsmInstruction{Inst: inst, Pc: pc, Pos: pos})
+			if rowStart {
+				r[len(r)-1].IsStmt = lne.IsStmt
+				r[len(r)-1].PrologueEnd = lne.PrologueEnd
+				r[len(r)-1].EpilogueBegin = lne.EpilogueBegin
+			}
+			if inst.Op == x86asm.JMP {
+				r[len(r)-1].JumpTable = exe.jumpTable(r, start, end)
+			}
 			mem = mem[inst.Len:]
 			pc += uint64(inst.Len)
 		} else {
-			r = append(r, AsmInstruction{})
+			r = append(r, AsmInstruction{Pc: pc, Undecodable: true})
 			mem = mem[1:]
 			pc++
 		}
 	}
+	markPadding(r)
+	return r
+}
+
+// markPadding marks INT3 instructions and the NOPs at the end of text as
+// padding.
+func markPadding(text []AsmInstruction) {
+	for i := range text {
+		if isInt3(text[i].Inst) {
+			text[i].Padding = true
+		}
+	}
+	for i := len(text) - 1; i >= 0 && (isInt3(text[i].Inst) || text[i].Inst.Op == x86asm.NOP); i-- {
+		text[i].Padding = true
+	}
+}
+
+func isInt3(inst x86asm.Inst) bool {
+	return inst.Op == x86asm.INT && inst.Args[0] == x86asm.Imm(3)
+}
+
+// maxJumpTableLookback is the maximum number of instructions before an
+// indirect jump searched for the instructions loading its jump table.
+const maxJumpTableLookback = 8
+
+// jumpTable returns the destinations of the indirect jump at the end of
+// text, if it jumps through a jump table, as generated by the compiler for
+// dense switch statements:
+//
+//	CMPQ idx, $n-1
+//	JA default
+//	LEAQ table(IP), reg
+//	JMP 0(reg)(idx*8)
+//
+// Without the bounds check the table is assumed to end at the first entry
+// that is outside of the function [start, end).
+func (exe *Executable) jumpTable(text []AsmInstruction, start, end uint64) []uint64 {
+	jmp := text[len(text)-1].Inst
+	mem, ok := jmp.Args[0].(x86asm.Mem)
+	if !ok || mem.Base == 0 || mem.Index == 0 || mem.Scale != 8 || mem.Disp != 0 {
+		return nil
+	}
+
+	table, n := uint64(0), -1
+	for i := len(text) - 2; i >= 0 && i >= len(text)-1-maxJumpTableLookback; i-- {
+		inst := text[i].Inst
+		switch inst.Op {
+		case x86asm.LEA:
+			if table != 0 || inst.Args[0] != mem.Base {
+				continue
+			}
+			src, ok := inst.Args[1].(x86asm.Mem)
+			if !ok || src.Base != x86asm.RIP || src.Index != 0 {
+				return nil
+			}
+			table = uint64(int64(text[i].Pc) + int64(inst.Len) + src.Disp)
+		case x86asm.CMP:
+			if inst.Args[0] != mem.Index || i+1 >= len(text) {
+				continue
+			}
+			bound, ok := inst.Args[1].(x86asm.Imm)
+			if !ok {
+				continue
+			}
+			switch text[i+1].Inst.Op {
+			case x86asm.JA:
+				n = int(bound) + 1
+			case x86asm.JAE:
+				n = int(bound)
+			}
+		}
+		if table != 0 && n >= 0 {
+			break
+		}
+	}
+	if table == 0 {
+		return nil
+	}
+
+	r := []uint64{}
+	for i := 0; n < 0 || i < n; i++ {
+		buf, err := exe.ReadMemory(table+uint64(i*8), 8)
+		if err != nil {
+			break
+		}
+		dest := binary.LittleEndian.Uint64(buf)
+		if dest < start || dest >= end {
+			if n >= 0 {
+				// the bounds check was not for this table
+				return nil
+			}
+			break
+		}
+		r = append(r, dest)
+	}
 	return r
 }
 
@@ -116,20 +417,31 @@ func patchPCRel(pc uint64, inst *x86asm.Inst) {
 	return
 }
 
-func AllFiles(funcs []Function) []string {
-	m := map[string]struct{}{}
-
+// AllFiles returns the import paths of the packages of the functions the
+// instructions of funcs belong to, including inlined calls, for each file
+// the instructions are attributed to. Functions renamed with go:linkname
+// add the package of their new name to their file.
+func AllFiles(funcs []Function) map[string][]string {
+	r := map[string][]string{}
 	for i := range funcs {
 		fn := &funcs[i]
 		for i := range fn.Text {
-			m[fn.Text[i].Pos.File] = struct{}{}
+			inst := &fn.Text[i]
+			name := fn.Name
+			if inst.Inlined != nil {
+				name = inst.Inlined.Name
+			}
+			r[inst.Pos.File] = appendUnique(r[inst.Pos.File], funcPackage(name))
 		}
 	}
+	return r
+}
 
-	r := make([]string, 0, len(m))
-	for k := range m {
-		r = append(r, k)
+func appendUnique(v []string, s string) []string {
+	for _, x := range v {
+		if x == s {
+			return v
+		}
 	}
-	sort.Strings(r)
-	return r
+	return append(v, s)
 }
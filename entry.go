@@ -0,0 +1,174 @@
+package main
+
+import (
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// maxStackCheckLen is the maximum number of instructions of the stack
+// check at the start of a function.
+const maxStackCheckLen = 4
+
+// EntryBreakpoint returns the index of the instruction where a debugger
+// puts a breakpoint set on fn: the first instruction with prologue_end or,
+// if there is none, the instruction following the stack check.
+func (fn *Function) EntryBreakpoint() int {
+	for i := range fn.Text {
+		if fn.Text[i].PrologueEnd {
+			return i
+		}
+	}
+	if i := fn.stackCheckEnd(); i >= 0 {
+		return i
+	}
+	return 0
+}
+
+// stackCheckEnd returns the index of the first instruction after the stack
+// check at the start of fn:
+//
+//	CMPQ 0x10(R14), SP	or	LEAQ -framesize(SP), R12; CMPQ 0x10(R14), R12
+//	JBE morestack
+//
+// Returns -1 if fn does not have a stack check.
+func (fn *Function) stackCheckEnd() int {
+	return stackCheckEnd(fn.Text)
+}
+
+func stackCheckEnd(text []AsmInstruction) int {
+	for i := 0; i+1 < len(text) && i < maxStackCheckLen; i++ {
+		inst := text[i].Inst
+		if inst.Op != x86asm.CMP {
+			continue
+		}
+		mem, ok := inst.Args[1].(x86asm.Mem)
+		if !ok || mem.Base != x86asm.R14 {
+			// the stack guard is loaded from the g struct, always in R14
+			continue
+		}
+		switch text[i+1].Inst.Op {
+		case x86asm.JBE, x86asm.JB:
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// entrySpills returns the index of the instruction following the last
+// spill of an argument register to the stack, in the sequence of frame
+// setup, spills and zeroing of stack slots that follows the stack check.
+// Returns -1 if there are no spills.
+func (fn *Function) entrySpills() int {
+	start := fn.stackCheckEnd()
+	if start < 0 {
+		start = 0
+	}
+	r := -1
+	for i := start; i < len(fn.Text); i++ {
+		inst := fn.Text[i].Inst
+		switch {
+		case isFrameSetup(inst):
+			// ok
+		case isStackStore(inst):
+			if reg, ok := inst.Args[1].(x86asm.Reg); ok && isArgReg(reg) {
+				r = i + 1
+			}
+		default:
+			return r
+		}
+	}
+	return r
+}
+
+func isFrameSetup(inst x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.PUSH:
+		return inst.Args[0] == x86asm.RBP
+	case x86asm.MOV:
+		return inst.Args[0] == x86asm.RBP && inst.Args[1] == x86asm.RSP
+	case x86asm.SUB, x86asm.ADD:
+		_, isimm := inst.Args[1].(x86asm.Imm)
+		return inst.Args[0] == x86asm.RSP && isimm
+	}
+	return false
+}
+
+// isStackStore returns true if inst moves a register or a constant into a
+// stack slot, not into an element of an array on the stack.
+func isStackStore(inst x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.MOV, x86asm.MOVSD_XMM, x86asm.MOVSS, x86asm.MOVUPS, x86asm.MOVAPS, x86asm.MOVQ:
+	default:
+		return false
+	}
+	mem, ok := inst.Args[0].(x86asm.Mem)
+	return ok && (mem.Base == x86asm.RSP || mem.Base == x86asm.RBP) && mem.Index == 0
+}
+
+// isArgReg returns true if reg, or a part of it, is used to pass arguments
+// by the register based calling convention.
+func isArgReg(reg x86asm.Reg) bool {
+	switch reg {
+	case x86asm.AL, x86asm.BL, x86asm.CL, x86asm.DIB, x86asm.SIB, x86asm.R8B, x86asm.R9B, x86asm.R10B, x86asm.R11B,
+		x86asm.AX, x86asm.BX, x86asm.CX, x86asm.DI, x86asm.SI, x86asm.R8W, x86asm.R9W, x86asm.R10W, x86asm.R11W,
+		x86asm.EAX, x86asm.EBX, x86asm.ECX, x86asm.EDI, x86asm.ESI, x86asm.R8L, x86asm.R9L, x86asm.R10L, x86asm.R11L,
+		x86asm.RAX, x86asm.RBX, x86asm.RCX, x86asm.RDI, x86asm.RSI, x86asm.R8, x86asm.R9, x86asm.R10, x86asm.R11:
+		return true
+	}
+	return reg >= x86asm.X0 && reg <= x86asm.X14
+}
+
+// checkEntry checks the breakpoint a debugger would set on fn, it must be
+// on the line of the declaration of fn or on one of its first statements,
+// after the stack check and the spill of arguments.
+func checkEntry(fn *Function, succs *Successors) int {
+	if len(fn.Text) == 0 {
+		return 0
+	}
+	bp := fn.EntryBreakpoint()
+	inst := fn.Text[bp]
+	printf(C, "entry breakpoint %s:%d %#x\n", inst.Pos.File, inst.Pos.Line, inst.Pc)
+
+	penalty := 0
+	decl := succs.ToPos(fn.Decl.Pos())
+	if set := succs.S[decl]; inst.Pos != decl && !set.Contains(inst.Pos) {
+		report(CatEntry, inst.Pos, inst.Pc, "entry breakpoint is not on the declaration or on the first statement of %s", fn.Name)
+		penalty += EntryPenalty
+	}
+	if end := fn.stackCheckEnd(); bp < end {
+		report(CatEntry, inst.Pos, inst.Pc, "entry breakpoint is before the end of the stack check at %#x", fn.Text[end].Pc)
+		penalty += EntryPenalty
+	}
+	if end := fn.entrySpills(); bp < end {
+		report(CatEntry, inst.Pos, inst.Pc, "entry breakpoint is before the spill of arguments at %#x", fn.Text[end-1].Pc)
+		penalty += EntryPenalty
+	}
+	return penalty
+}
+
+// checkMorestack checks the blocks calling runtime.morestack when the
+// stack needs to grow, they must be attributed to the line of the
+// declaration of fn and must not contain stops.
+func checkMorestack(fn *Function, bg *BlockGraph, succs *Successors) int {
+	decl := succs.ToPos(fn.Decl.Pos())
+	penalty := 0
+	misattributed, stop := false, false
+	for _, b := range bg.Blocks {
+		if !b.Morestack {
+			continue
+		}
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			if inst.Pos != decl && !misattributed {
+				misattributed = true
+				report(CatMorestack, inst.Pos, inst.Pc, "stack growth code is not attributed to the declaration of %s", fn.Name)
+				penalty += MorestackPenalty
+			}
+			if inst.IsStmt && !stop {
+				stop = true
+				report(CatMorestack, inst.Pos, inst.Pc, "stop in stack growth code")
+				penalty += MorestackPenalty
+			}
+		}
+	}
+	return penalty
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"io"
+	"path/filepath"
+)
+
+// Graph is the statement-level control flow graph of a function.
+// The acceptable successors and the groups of each line (see Successors)
+// are derived from it.
+type Graph struct {
+	Name  string
+	Entry *Node // function declaration
+	Exit  *Node // return to the caller
+	Any   *Node // any line of the function, the target of goto, break and continue
+	Nodes []*Node
+
+	NoCode []Pos // lines that only contain constants
+}
+
+type NodeKind uint8
+
+const (
+	NodeEntry  NodeKind = iota // declaration of the function
+	NodeExit                   // return to the caller
+	NodeAny                    // any line of the function
+	NodeStmt                   // a simple statement
+	NodeExpr                   // a sub-expression of a compound statement (condition, tag, range expression)
+	NodeBrace                  // opening or closing brace of a block
+	NodeLabel                  // label of a statement
+	NodeClause                 // case or comm clause of a switch or select
+	NodeInline                 // entry of an inlined call, see SpliceInlined
+)
+
+var nodeKindNames = [...]string{"entry", "exit", "any", "stmt", "expr", "brace", "label", "clause", "inline"}
+
+func (k NodeKind) String() string {
+	if int(k) < len(nodeKindNames) {
+		return nodeKindNames[k]
+	}
+	return fmt.Sprintf("NodeKind(%d)", k)
+}
+
+type EdgeKind uint8
+
+const (
+	EdgeNext         EdgeKind = iota // execution continues normally
+	EdgeLoop                         // back edge to the header of a loop
+	EdgeReturn                       // return from the function
+	EdgeDefer                        // deferred call executed when the function returns
+	EdgeJump                         // goto, break or continue
+	EdgeQuasi                        // quasi-acceptable continuation, exit from an if or switch
+	EdgeInline                       // call of an inlined function
+	EdgeInlineReturn                 // return from an inlined function to its caller
+)
+
+var edgeKindNames = [...]string{"next", "loop", "return", "defer", "jump", "quasi", "inline", "inline return"}
+
+func (k EdgeKind) String() string {
+	if int(k) < len(edgeKindNames) {
+		return edgeKindNames[k]
+	}
+	return fmt.Sprintf("EdgeKind(%d)", k)
+}
+
+// Node is a statement or sub-expression, it spans one or more lines.
+type Node struct {
+	ID       int
+	Kind     NodeKind
+	Lines    []Pos
+	Group    uint64 // see Successors.G
+	AnyOrder bool   // lines of the node can be executed in any order
+	AST      ast.Node
+	Out, In  []Edge
+}
+
+type Edge struct {
+	From, To *Node
+	Kind     EdgeKind
+}
+
+const noGroup = ^uint64(0)
+
+func newGraph(name string) *Graph {
+	g := &Graph{Name: name}
+	g.Exit = g.newNode(NodeExit, nil, noGroup, Pos{File: "", Line: -1})
+	g.Any = g.newNode(NodeAny, nil, noGroup)
+	return g
+}
+
+func (g *Graph) newNode(kind NodeKind, x ast.Node, group uint64, lines ...Pos) *Node {
+	n := &Node{ID: len(g.Nodes), Kind: kind, Lines: lines, Group: group, AST: x}
+	g.Nodes = append(g.Nodes, n)
+	return n
+}
+
+func (g *Graph) addEdge(from, to *Node, kind EdgeKind) {
+	for _, e := range from.Out {
+		if e.To == to && e.Kind == kind {
+			return
+		}
+	}
+	e := Edge{from, to, kind}
+	from.Out = append(from.Out, e)
+	to.In = append(to.In, e)
+}
+
+// clone returns a copy of g, nodes keep their IDs.
+func (g *Graph) clone() *Graph {
+	r := &Graph{Name: g.Name, NoCode: g.NoCode}
+	for _, n := range g.Nodes {
+		c := *n
+		c.Out, c.In = nil, nil
+		r.Nodes = append(r.Nodes, &c)
+	}
+	for _, n := range g.Nodes {
+		for _, e := range n.Out {
+			r.addEdge(r.Nodes[e.From.ID], r.Nodes[e.To.ID], e.Kind)
+		}
+	}
+	r.Entry, r.Exit, r.Any = r.Nodes[g.Entry.ID], r.Nodes[g.Exit.ID], r.Nodes[g.Any.ID]
+	return r
+}
+
+// addTo adds the successors and groups of the lines of g to s. The
+// returns from the calls inlined in g are left out: the lines of a callee
+// are shared by all its callers, see Successors.acceptsIn.
+func (g *Graph) addTo(s *Successors) {
+	for _, pos := range g.NoCode {
+		s.NoCode[pos] = true
+	}
+
+	for _, n := range g.Nodes {
+		if n.Group == noGroup {
+			continue
+		}
+		for _, pos := range n.Lines {
+			if _, hasgroup := s.G[pos]; !hasgroup {
+				s.G[pos] = n.Group
+			}
+		}
+	}
+
+	for _, n := range g.Nodes {
+		if n.AnyOrder {
+			for _, pos := range n.Lines {
+				s.addsucc(pos, n.Lines...)
+			}
+		}
+		for _, e := range n.Out {
+			for _, pos := range n.Lines {
+				switch {
+				case e.Kind == EdgeInlineReturn:
+				case e.Kind == EdgeQuasi:
+					s.addqsucc(pos, e.To.Lines...)
+				case e.To == g.Any:
+					set := s.S[pos]
+					set.Any = true
+					s.S[pos] = set
+				default:
+					s.addsucc(pos, e.To.Lines...)
+				}
+			}
+		}
+	}
+}
+
+// Reachable returns the set of nodes reachable from n.
+func (g *Graph) Reachable(n *Node) map[*Node]bool {
+	r := map[*Node]bool{n: true}
+	stack := []*Node{n}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, e := range n.Out {
+			if !r[e.To] {
+				r[e.To] = true
+				stack = append(stack, e.To)
+			}
+		}
+	}
+	return r
+}
+
+// Dominators returns the immediate dominator of each node reachable from
+// the entry of the function, the entry node is its own immediate
+// dominator. Quasi-acceptable edges are ignored.
+func (g *Graph) Dominators() map[*Node]*Node {
+	// Cooper, Harvey, Kennedy. "A Simple, Fast Dominance Algorithm"
+	order := g.postorder()
+	index := make(map[*Node]int, len(order))
+	for i, n := range order {
+		index[n] = i
+	}
+
+	idom := map[*Node]*Node{g.Entry: g.Entry}
+
+	intersect := func(a, b *Node) *Node {
+		for a != b {
+			for index[a] < index[b] {
+				a = idom[a]
+			}
+			for index[b] < index[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(order) - 1; i >= 0; i-- {
+			n := order[i]
+			if n == g.Entry {
+				continue
+			}
+			var newidom *Node
+			for _, e := range n.In {
+				if e.Kind == EdgeQuasi || idom[e.From] == nil {
+					continue
+				}
+				if newidom == nil {
+					newidom = e.From
+				} else {
+					newidom = intersect(e.From, newidom)
+				}
+			}
+			if newidom != nil && idom[n] != newidom {
+				idom[n] = newidom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+// Dominates returns true if a dominates b, idom is the result of Dominators.
+func Dominates(idom map[*Node]*Node, a, b *Node) bool {
+	for {
+		if a == b {
+			return true
+		}
+		next := idom[b]
+		if next == nil || next == b {
+			return false
+		}
+		b = next
+	}
+}
+
+func (g *Graph) postorder() []*Node {
+	r := []*Node{}
+	seen := map[*Node]bool{}
+	var visit func(n *Node)
+	visit = func(n *Node) {
+		seen[n] = true
+		for _, e := range n.Out {
+			if e.Kind != EdgeQuasi && !seen[e.To] {
+				visit(e.To)
+			}
+		}
+		r = append(r, n)
+	}
+	visit(g.Entry)
+	return r
+}
+
+// Loop is a loop of the source code, the natural loop of all the back
+// edges (EdgeLoop) to Header.
+type Loop struct {
+	Header *Node
+	Body   map[*Node]bool // includes Header
+	Parent *Loop          // innermost enclosing loop
+}
+
+// Loops returns all loops of the function, outer loops come first.
+func (g *Graph) Loops() []*Loop {
+	byHeader := map[*Node]*Loop{}
+	loops := []*Loop{}
+	for _, n := range g.Nodes {
+		for _, e := range n.Out {
+			if e.Kind != EdgeLoop {
+				continue
+			}
+			loop := byHeader[e.To]
+			if loop == nil {
+				loop = &Loop{Header: e.To, Body: map[*Node]bool{e.To: true}}
+				byHeader[e.To] = loop
+				loops = append(loops, loop)
+			}
+			stack := []*Node{}
+			if !loop.Body[n] {
+				loop.Body[n] = true
+				stack = append(stack, n)
+			}
+			for len(stack) > 0 {
+				m := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				for _, e := range m.In {
+					if e.Kind != EdgeQuasi && !loop.Body[e.From] {
+						loop.Body[e.From] = true
+						stack = append(stack, e.From)
+					}
+				}
+			}
+		}
+	}
+
+	for _, loop := range loops {
+		for _, outer := range loops {
+			if outer == loop || !outer.Body[loop.Header] || len(outer.Body) <= len(loop.Body) {
+				continue
+			}
+			if loop.Parent == nil || len(outer.Body) < len(loop.Parent.Body) {
+				loop.Parent = outer
+			}
+		}
+	}
+
+	depth := func(loop *Loop) int {
+		d := 0
+		for ; loop != nil; loop = loop.Parent {
+			d++
+		}
+		return d
+	}
+	for i := 1; i < len(loops); i++ {
+		for j := i; j > 0 && depth(loops[j]) < depth(loops[j-1]); j-- {
+			loops[j], loops[j-1] = loops[j-1], loops[j]
+		}
+	}
+
+	return loops
+}
+
+// LoopDepth returns the number of loops containing n.
+func LoopDepth(loops []*Loop, n *Node) int {
+	d := 0
+	for _, loop := range loops {
+		if loop.Body[n] {
+			d++
+		}
+	}
+	return d
+}
+
+func (n *Node) label() string {
+	if len(n.Lines) == 0 {
+		return n.Kind.String()
+	}
+	first, last := n.Lines[0], n.Lines[len(n.Lines)-1]
+	if first.Line < 0 {
+		return n.Kind.String()
+	}
+	if first == last {
+		return fmt.Sprintf("%s %s:%d", n.Kind, filepath.Base(first.File), first.Line)
+	}
+	return fmt.Sprintf("%s %s:%d-%d", n.Kind, filepath.Base(first.File), first.Line, last.Line)
+}
+
+type jsonGraph struct {
+	Name   string
+	Nodes  []jsonNode
+	Edges  []jsonEdge
+	NoCode []Pos `json:",omitempty"`
+}
+
+type jsonNode struct {
+	ID       int
+	Kind     string
+	Lines    []Pos
+	Group    string `json:",omitempty"`
+	AnyOrder bool   `json:",omitempty"`
+}
+
+type jsonEdge struct {
+	From, To int
+	Kind     string
+}
+
+// WriteJSON writes graphs to w as a JSON array.
+func WriteJSON(w io.Writer, graphs []*Graph) error {
+	out := make([]jsonGraph, 0, len(graphs))
+	for _, g := range graphs {
+		jg := jsonGraph{Name: g.Name, Nodes: []jsonNode{}, Edges: []jsonEdge{}, NoCode: g.NoCode}
+		for _, n := range g.Nodes {
+			jn := jsonNode{ID: n.ID, Kind: n.Kind.String(), Lines: n.Lines, AnyOrder: n.AnyOrder}
+			if n.Group != noGroup {
+				jn.Group = fmt.Sprintf("%d.%d", n.Group>>32, n.Group&groupMask)
+			}
+			if jn.Lines == nil {
+				jn.Lines = []Pos{}
+			}
+			jg.Nodes = append(jg.Nodes, jn)
+			for _, e := range n.Out {
+				jg.Edges = append(jg.Edges, jsonEdge{e.From.ID, e.To.ID, e.Kind.String()})
+			}
+		}
+		out = append(out, jg)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(out)
+}
+
+// WriteDOT writes graphs to w in the graphviz format, one digraph per
+// function.
+func WriteDOT(w io.Writer, graphs []*Graph) error {
+	for _, g := range graphs {
+		if _, err := fmt.Fprintf(w, "digraph %q {\n", g.Name); err != nil {
+			return err
+		}
+		for _, n := range g.Nodes {
+			shape := "box"
+			switch n.Kind {
+			case NodeEntry, NodeExit, NodeAny, NodeInline:
+				shape = "ellipse"
+			case NodeExpr, NodeClause:
+				shape = "diamond"
+			}
+			fmt.Fprintf(w, "\tn%d [label=%q shape=%s];\n", n.ID, n.label(), shape)
+		}
+		for _, n := range g.Nodes {
+			for _, e := range n.Out {
+				style := ""
+				switch e.Kind {
+				case EdgeQuasi:
+					style = " style=dotted"
+				case EdgeLoop, EdgeReturn, EdgeDefer, EdgeJump, EdgeInline, EdgeInlineReturn:
+					style = " style=dashed"
+				}
+				fmt.Fprintf(w, "\tn%d -> n%d [label=%q%s];\n", e.From.ID, e.To.ID, e.Kind.String(), style)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "}\n\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
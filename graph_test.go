@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// testGraph returns the graph of
+//
+//	3 func f() {
+//	4 	for a() {
+//	5 		b()
+//	6 		for c() {
+//	7 			d()
+//	8 		}
+//	9 	}
+//	10 	e()
+//	11 }
+//
+// with a quasi-acceptable edge from the entry to line 7.
+func testGraph() (*Graph, []*Node) {
+	g := newGraph("main.f")
+	pos := func(line int) Pos { return Pos{"a.go", line} }
+	entry := g.newNode(NodeEntry, nil, 1<<32, pos(3))
+	g.Entry = entry
+	n := []*Node{
+		g.Exit,
+		g.Any,
+		entry,
+		g.newNode(NodeExpr, nil, 1<<32|1, pos(4)),
+		g.newNode(NodeStmt, nil, 1<<32|2, pos(5)),
+		g.newNode(NodeExpr, nil, 1<<32|3, pos(6)),
+		g.newNode(NodeStmt, nil, 1<<32|4, pos(7)),
+		g.newNode(NodeStmt, nil, 1<<32|5, pos(10)),
+	}
+	g.addEdge(n[2], n[3], EdgeNext)
+	g.addEdge(n[3], n[4], EdgeNext)
+	g.addEdge(n[4], n[5], EdgeNext)
+	g.addEdge(n[5], n[6], EdgeNext)
+	g.addEdge(n[6], n[5], EdgeLoop)
+	g.addEdge(n[5], n[3], EdgeLoop)
+	g.addEdge(n[3], n[7], EdgeNext)
+	g.addEdge(n[7], n[0], EdgeReturn)
+	g.addEdge(n[2], n[6], EdgeQuasi)
+	return g, n
+}
+
+func TestGraphDominators(t *testing.T) {
+	g, n := testGraph()
+	idom := g.Dominators()
+	for _, tc := range []struct{ node, idom int }{
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{5, 4},
+		{6, 5}, // the quasi-acceptable edge from the entry is ignored
+		{7, 3},
+		{0, 7},
+	} {
+		if idom[n[tc.node]] != n[tc.idom] {
+			t.Errorf("immediate dominator of node %d: %v, want node %d", tc.node, idom[n[tc.node]], tc.idom)
+		}
+	}
+	if _, ok := idom[n[1]]; ok {
+		t.Errorf("unreachable node %d has a dominator", 1)
+	}
+	if !Dominates(idom, n[3], n[6]) || Dominates(idom, n[6], n[3]) || !Dominates(idom, n[4], n[4]) {
+		t.Errorf("wrong dominance between nodes 3, 4 and 6")
+	}
+}
+
+func TestGraphLoops(t *testing.T) {
+	g, n := testGraph()
+	loops := g.Loops()
+	if len(loops) != 2 {
+		t.Fatalf("%d loops, want 2", len(loops))
+	}
+	outer, inner := loops[0], loops[1]
+	for _, tc := range []struct {
+		loop   *Loop
+		header int
+		body   []int
+		parent *Loop
+	}{
+		{outer, 3, []int{3, 4, 5, 6}, nil},
+		{inner, 5, []int{5, 6}, outer},
+	} {
+		if tc.loop.Header != n[tc.header] || tc.loop.Parent != tc.parent || len(tc.loop.Body) != len(tc.body) {
+			t.Errorf("loop at node %d: header %d, %d nodes, want header %d, nodes %v", tc.loop.Header.ID, tc.loop.Header.ID, len(tc.loop.Body), tc.header, tc.body)
+			continue
+		}
+		for _, id := range tc.body {
+			if !tc.loop.Body[n[id]] {
+				t.Errorf("node %d not in the loop at node %d", id, tc.header)
+			}
+		}
+	}
+	for id, want := range []int{0, 0, 0, 1, 1, 2, 2, 0} {
+		if d := LoopDepth(loops, n[id]); d != want {
+			t.Errorf("loop depth of node %d: %d, want %d", id, d, want)
+		}
+	}
+}
+
+func TestWriteGraphs(t *testing.T) {
+	g, _ := testGraph()
+	g.NoCode = []Pos{{"a.go", 8}}
+	for _, tc := range []struct {
+		name  string
+		write func(*bytes.Buffer) error
+		want  string
+	}{
+		{"json", func(buf *bytes.Buffer) error {
+			var out bytes.Buffer
+			if err := WriteJSON(&out, []*Graph{g}); err != nil {
+				return err
+			}
+			return json.Compact(buf, out.Bytes())
+		}, graphJSON},
+		{"dot", func(buf *bytes.Buffer) error { return WriteDOT(buf, []*Graph{g}) }, graphDOT},
+	} {
+		var buf bytes.Buffer
+		if err := tc.write(&buf); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, buf.String(), tc.want)
+		}
+	}
+}
+
+const graphJSON = `[{"Name":"main.f","Nodes":[` +
+	`{"ID":0,"Kind":"exit","Lines":[{"File":"","Line":-1}]},` +
+	`{"ID":1,"Kind":"any","Lines":[]},` +
+	`{"ID":2,"Kind":"entry","Lines":[{"File":"a.go","Line":3}],"Group":"1.0"},` +
+	`{"ID":3,"Kind":"expr","Lines":[{"File":"a.go","Line":4}],"Group":"1.1"},` +
+	`{"ID":4,"Kind":"stmt","Lines":[{"File":"a.go","Line":5}],"Group":"1.2"},` +
+	`{"ID":5,"Kind":"expr","Lines":[{"File":"a.go","Line":6}],"Group":"1.3"},` +
+	`{"ID":6,"Kind":"stmt","Lines":[{"File":"a.go","Line":7}],"Group":"1.4"},` +
+	`{"ID":7,"Kind":"stmt","Lines":[{"File":"a.go","Line":10}],"Group":"1.5"}],"Edges":[` +
+	`{"From":2,"To":3,"Kind":"next"},` +
+	`{"From":2,"To":6,"Kind":"quasi"},` +
+	`{"From":3,"To":4,"Kind":"next"},` +
+	`{"From":3,"To":7,"Kind":"next"},` +
+	`{"From":4,"To":5,"Kind":"next"},` +
+	`{"From":5,"To":6,"Kind":"next"},` +
+	`{"From":5,"To":3,"Kind":"loop"},` +
+	`{"From":6,"To":5,"Kind":"loop"},` +
+	`{"From":7,"To":0,"Kind":"return"}],` +
+	`"NoCode":[{"File":"a.go","Line":8}]}]`
+
+const graphDOT = `digraph "main.f" {
+	n0 [label="exit" shape=ellipse];
+	n1 [label="any" shape=ellipse];
+	n2 [label="entry a.go:3" shape=ellipse];
+	n3 [label="expr a.go:4" shape=diamond];
+	n4 [label="stmt a.go:5" shape=box];
+	n5 [label="expr a.go:6" shape=diamond];
+	n6 [label="stmt a.go:7" shape=box];
+	n7 [label="stmt a.go:10" shape=box];
+	n2 -> n3 [label="next"];
+	n2 -> n6 [label="quasi" style=dotted];
+	n3 -> n4 [label="next"];
+	n3 -> n7 [label="next"];
+	n4 -> n5 [label="next"];
+	n5 -> n6 [label="next"];
+	n5 -> n3 [label="loop" style=dashed];
+	n6 -> n5 [label="loop" style=dashed];
+	n7 -> n0 [label="return" style=dashed];
+}
+
+`
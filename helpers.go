@@ -0,0 +1,223 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// HelperKind is the kind of a sequence of instructions generated by the
+// compiler that does not correspond to user code.
+type HelperKind uint8
+
+const (
+	HelperNone         HelperKind = iota
+	HelperWriteBarrier            // block calling runtime.gcWriteBarrier*
+	HelperDuff                    // call into the middle of runtime.duffzero or runtime.duffcopy
+	HelperSpill                   // register saved to the stack before a call
+	HelperRestore                 // register loaded back from the stack after a call
+	HelperPanic                   // block at the end of the function calling a function that does not return
+	HelperDefer                   // open-coded call of a deferred function, see labelDefers
+	HelperDeferreturn             // block calling runtime.deferreturn when recovering from a panic
+	HelperRaceEnter               // call of runtime.racefuncenter, see labelInstrumentation
+	HelperRaceExit                // call of runtime.racefuncexit
+	HelperAccess                  // call checking a memory access for the race detector or a sanitizer
+	HelperCover                   // increment of a coverage counter
+)
+
+var helperNames = [...]string{"", "write barrier", "duff", "spill", "restore", "panic stub", "defer", "deferreturn", "racefuncenter", "racefuncexit", "access check", "coverage counter"}
+
+func (k HelperKind) String() string {
+	return helperNames[k]
+}
+
+// Instrumentation returns true for the code inserted to instrument a
+// function.
+func (k HelperKind) Instrumentation() bool {
+	switch k {
+	case HelperRaceEnter, HelperRaceExit, HelperAccess, HelperCover:
+		return true
+	}
+	return false
+}
+
+// callTarget returns the name of the function called by inst and the
+// offset of the destination from its entry point.
+func callTarget(exe *Executable, inst AsmInstruction) (name string, off uint64, ok bool) {
+	if inst.Inst.Op != x86asm.CALL || exe.Gosym == nil {
+		return "", 0, false
+	}
+	imm, isimm := inst.Inst.Args[0].(x86asm.Imm)
+	if !isimm {
+		return "", 0, false
+	}
+	dest := exe.Gosym.PCToFunc(uint64(imm))
+	if dest == nil {
+		return "", 0, false
+	}
+	return dest.Name, uint64(imm) - dest.Entry, true
+}
+
+// labelHelpers sets the Helper field of the instructions of bg that are
+// part of helper sequences.
+func (bg *BlockGraph) labelHelpers(exe *Executable) {
+	text := bg.Text
+	// first instruction spilling a register to each stack slot
+	spilled := map[x86asm.Mem]int{}
+	for i := range text {
+		inst := text[i].Inst
+		if !isStackStore(inst) || !isRegArg(inst.Args[1]) || inst.Args[1] == x86asm.X15 {
+			continue
+		}
+		if _, ok := spilled[inst.Args[0].(x86asm.Mem)]; !ok {
+			spilled[inst.Args[0].(x86asm.Mem)] = i
+		}
+	}
+	for _, b := range bg.Blocks {
+		for i := b.Start; i < b.End; i++ {
+			name, off, ok := callTarget(exe, text[i])
+			if !ok {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(name, "runtime.gcWriteBarrier"):
+				bg.labelBlock(b, HelperWriteBarrier)
+			case (name == "runtime.duffzero" || name == "runtime.duffcopy") && off != 0:
+				text[i].Helper = HelperDuff
+				// the pointers to the memory are loaded right before
+				for j := i - 1; j >= b.Start && isDuffSetup(text[j].Inst); j-- {
+					text[j].Helper = HelperDuff
+				}
+			default:
+				for j := i - 1; j >= b.Start && isStackStore(text[j].Inst) && isRegArg(text[j].Inst.Args[1]); j-- {
+					text[j].Helper = HelperSpill
+				}
+				for j := i + 1; j < b.End && isStackLoad(text[j].Inst); j++ {
+					if first, ok := spilled[text[j].Inst.Args[1].(x86asm.Mem)]; !ok || first > i {
+						break
+					}
+					text[j].Helper = HelperRestore
+				}
+			}
+		}
+
+		last := text[b.End-1]
+		if isNoReturnCall(exe, last) {
+			fallsIn := false
+			for _, e := range b.In {
+				if e.Kind == BlockFallthrough {
+					fallsIn = true
+				}
+			}
+			if !fallsIn && len(b.In) > 0 {
+				bg.labelBlock(b, HelperPanic)
+			}
+		}
+	}
+}
+
+func (bg *BlockGraph) labelBlock(b *Block, kind HelperKind) {
+	for i := b.Start; i < b.End; i++ {
+		bg.Text[i].Helper = kind
+	}
+}
+
+func isDuffSetup(inst x86asm.Inst) bool {
+	if inst.Op != x86asm.LEA && inst.Op != x86asm.MOV {
+		return false
+	}
+	return inst.Args[0] == x86asm.RDI || inst.Args[0] == x86asm.RSI
+}
+
+func isRegArg(arg x86asm.Arg) bool {
+	_, ok := arg.(x86asm.Reg)
+	return ok
+}
+
+// isStackLoad returns true if inst loads a register from a stack slot,
+// not from an element of an array on the stack.
+func isStackLoad(inst x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.MOV, x86asm.MOVSD_XMM, x86asm.MOVSS, x86asm.MOVUPS, x86asm.MOVAPS, x86asm.MOVQ:
+	default:
+		return false
+	}
+	mem, ok := inst.Args[1].(x86asm.Mem)
+	return ok && isRegArg(inst.Args[0]) && (mem.Base == x86asm.RSP || mem.Base == x86asm.RBP) && mem.Index == 0
+}
+
+// acceptHelper returns true if the i-th instruction, part of a helper
+// sequence of b, has acceptable line information.
+// Spills and restores can be attributed to any line, if they are stops
+// they are checked like user code. Deferred calls are checked by
+// checkDefers, instrumentation by checkInstrumentation. For the other
+// kinds only stops and the call, which appears in stack traces, are
+// visible to the user:
+//   - write barriers must be attributed to the line execution comes from;
+//   - the setup of a call of duffzero or duffcopy can also be attributed
+//     to the line of the call, the line of the copy;
+//   - stubs calling the panic functions of the runtime for failed bounds
+//     checks, divisions by zero and the like must be attributed to the
+//     line execution jumps from, other calls of functions that do not
+//     return, like a call of panic moved to the end of the function, can
+//     also be attributed to a successor of that line.
+func (bg *BlockGraph) acceptHelper(exe *Executable, succs *Successors, b *Block, i int) bool {
+	inst := bg.Text[i]
+	switch inst.Helper {
+	case HelperSpill, HelperRestore, HelperDefer, HelperDeferreturn:
+		return true
+	}
+	if inst.Helper.Instrumentation() {
+		return true
+	}
+	if !inst.IsStmt && inst.Inst.Op != x86asm.CALL {
+		return true
+	}
+	from := bg.helperOrigin(b, i)
+	if len(from) == 0 || containsPos(from, inst.Pos) {
+		return true
+	}
+	switch inst.Helper {
+	case HelperDuff:
+		for j := i + 1; j < b.End && bg.Text[j].Helper == HelperDuff; j++ {
+			if bg.Text[j].Inst.Op == x86asm.CALL {
+				return bg.Text[j].Pos == inst.Pos
+			}
+		}
+	case HelperPanic:
+		if isPanicStub(exe, bg.Text[b.End-1]) {
+			return false
+		}
+		for _, pos := range from {
+			if succs.accepts(pos, inst.Pos) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPanicStub returns true if inst calls one of the functions of the
+// runtime that the compiler calls when a check fails, like
+// runtime.panicIndex or runtime.panicdivide.
+func isPanicStub(exe *Executable, inst AsmInstruction) bool {
+	name, _, ok := callTarget(exe, inst)
+	return ok && strings.HasPrefix(name, "runtime.panic")
+}
+
+// helperOrigin returns the lines execution can come from when it enters
+// the helper sequence containing the i-th instruction, part of b.
+func (bg *BlockGraph) helperOrigin(b *Block, i int) []Pos {
+	for j := i - 1; j >= b.Start; j-- {
+		if bg.Text[j].Helper == HelperNone {
+			return []Pos{bg.Text[j].Pos}
+		}
+	}
+	r := []Pos{}
+	for _, e := range b.In {
+		if pos := bg.Text[e.From.End-1].Pos; !containsPos(r, pos) {
+			r = append(r, pos)
+		}
+	}
+	return r
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"debug/gosym"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+func TestLabelRestores(t *testing.T) {
+	exe := &Executable{Gosym: &gosym.Table{Funcs: []gosym.Func{
+		{Entry: 0x2000, End: 0x2100, Sym: &gosym.Sym{Name: "runtime.mapassign_faststr"}},
+	}}}
+	mov := func(dst, src x86asm.Arg) x86asm.Inst {
+		return x86asm.Inst{Op: x86asm.MOV, Args: x86asm.Args{dst, src}}
+	}
+	slot := func(disp int64) x86asm.Mem {
+		return x86asm.Mem{Base: x86asm.RSP, Disp: disp}
+	}
+	call := x86asm.Inst{Op: x86asm.CALL, Args: x86asm.Args{x86asm.Imm(0x2000)}}
+
+	for _, tc := range []struct {
+		name    string
+		text    []x86asm.Inst
+		restore []bool
+	}{
+		{
+			"spilled slot",
+			[]x86asm.Inst{mov(slot(0x20), x86asm.RAX), call, mov(x86asm.RCX, slot(0x20))},
+			[]bool{false, false, true},
+		},
+		{
+			"slot not spilled",
+			[]x86asm.Inst{call, mov(x86asm.RCX, slot(0x150))},
+			[]bool{false, false},
+		},
+		{
+			"slot spilled after the call",
+			[]x86asm.Inst{call, mov(x86asm.RCX, slot(0x20)), mov(slot(0x20), x86asm.RAX)},
+			[]bool{false, false, false},
+		},
+		{
+			"zeroed slot",
+			[]x86asm.Inst{mov(slot(0x20), x86asm.X15), call, mov(x86asm.RCX, slot(0x20))},
+			[]bool{false, false, false},
+		},
+		{
+			"array element",
+			[]x86asm.Inst{mov(slot(0x68), x86asm.RAX), call, mov(x86asm.RDX, x86asm.Mem{Base: x86asm.RSP, Index: x86asm.RCX, Scale: 8, Disp: 0x68})},
+			[]bool{false, false, false},
+		},
+	} {
+		text := make([]AsmInstruction, len(tc.text))
+		for i := range tc.text {
+			text[i] = AsmInstruction{Inst: tc.text[i], Pc: 0x1000 + uint64(i)}
+		}
+		bg := NewBlockGraph(text, exe)
+		for i := range text {
+			if got := bg.Text[i].Helper == HelperRestore; got != tc.restore[i] {
+				t.Errorf("%s: instruction %d restore %v, want %v", tc.name, i, got, tc.restore[i])
+			}
+		}
+	}
+}
+
+func TestAcceptHelper(t *testing.T) {
+	exe := &Executable{Gosym: &gosym.Table{Funcs: []gosym.Func{
+		{Entry: 0x2000, End: 0x2100, Sym: &gosym.Sym{Name: "runtime.gopanic"}},
+		{Entry: 0x2100, End: 0x2200, Sym: &gosym.Sym{Name: "runtime.panicIndex"}},
+		{Entry: 0x2200, End: 0x2300, Sym: &gosym.Sym{Name: "runtime.gcWriteBarrier2"}},
+		{Entry: 0x2300, End: 0x2400, Sym: &gosym.Sym{Name: "runtime.duffcopy"}},
+	}}}
+	s := Successors{S: map[Pos]PosSet{}}
+	s.addsucc(Pos{"a.go", 40}, Pos{"a.go", 41})
+	inst := func(op x86asm.Op, line int, stmt bool, args ...x86asm.Arg) AsmInstruction {
+		r := AsmInstruction{Inst: x86asm.Inst{Op: op}, Pos: Pos{"a.go", line}, IsStmt: stmt}
+		copy(r.Inst.Args[:], args)
+		return r
+	}
+
+	for _, tc := range []struct {
+		name   string
+		text   []AsmInstruction
+		helper HelperKind
+		accept map[int]bool
+	}{
+		{
+			"panic moved to the end of the function",
+			[]AsmInstruction{
+				inst(x86asm.CMP, 40, true), inst(x86asm.JNE, 40, false, x86asm.Imm(0x1003)), inst(x86asm.RET, 42, true),
+				inst(x86asm.LEA, 41, true), inst(x86asm.CALL, 41, false, x86asm.Imm(0x2000)),
+			},
+			HelperPanic,
+			map[int]bool{3: true, 4: true},
+		},
+		{
+			"panic on a line that does not follow",
+			[]AsmInstruction{
+				inst(x86asm.CMP, 40, true), inst(x86asm.JNE, 40, false, x86asm.Imm(0x1003)), inst(x86asm.RET, 42, true),
+				inst(x86asm.LEA, 50, true), inst(x86asm.CALL, 50, false, x86asm.Imm(0x2000)),
+			},
+			HelperPanic,
+			map[int]bool{3: false, 4: false},
+		},
+		{
+			"bounds check on the line of the check",
+			[]AsmInstruction{
+				inst(x86asm.CMP, 40, true), inst(x86asm.JNE, 40, false, x86asm.Imm(0x1003)), inst(x86asm.RET, 42, true),
+				inst(x86asm.MOV, 40, false), inst(x86asm.CALL, 40, false, x86asm.Imm(0x2100)),
+			},
+			HelperPanic,
+			map[int]bool{3: true, 4: true},
+		},
+		{
+			"bounds check on the following line",
+			[]AsmInstruction{
+				inst(x86asm.CMP, 40, true), inst(x86asm.JNE, 40, false, x86asm.Imm(0x1003)), inst(x86asm.RET, 42, true),
+				inst(x86asm.MOV, 41, false), inst(x86asm.CALL, 41, false, x86asm.Imm(0x2100)),
+			},
+			HelperPanic,
+			map[int]bool{3: true, 4: false},
+		},
+		{
+			"write barrier on the following line",
+			[]AsmInstruction{
+				inst(x86asm.MOV, 40, true), inst(x86asm.JMP, 40, false, x86asm.Imm(0x1002)),
+				inst(x86asm.MOV, 41, true), inst(x86asm.CALL, 41, false, x86asm.Imm(0x2200)),
+			},
+			HelperWriteBarrier,
+			map[int]bool{2: false, 3: false},
+		},
+		{
+			"duff setup on the line of the copy",
+			[]AsmInstruction{
+				inst(x86asm.MOV, 40, true), inst(x86asm.LEA, 41, true, x86asm.RDI), inst(x86asm.CALL, 41, false, x86asm.Imm(0x2310)),
+			},
+			HelperDuff,
+			map[int]bool{1: true, 2: false},
+		},
+	} {
+		for i := range tc.text {
+			tc.text[i].Pc = 0x1000 + uint64(i)
+		}
+		bg := NewBlockGraph(tc.text, exe)
+		for i, want := range tc.accept {
+			if bg.Text[i].Helper != tc.helper {
+				t.Errorf("%s: instruction %d labeled %q, want %q", tc.name, i, bg.Text[i].Helper, tc.helper)
+				continue
+			}
+			if got := bg.acceptHelper(exe, &s, bg.blockOf(i), i); got != want {
+				t.Errorf("%s: instruction %d accepted %v, want %v", tc.name, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"go/ast"
+	"strings"
+)
+
+// InlinedCallees returns a Function for each function that was inlined in
+// funcs and is not part of funcs, so that their graphs can be built.
+func InlinedCallees(funcs []Function) []Function {
+	seen := map[string]bool{}
+	for i := range funcs {
+		seen[funcs[i].Name] = true
+	}
+	r := []Function{}
+	for i := range funcs {
+		for _, ic := range funcs[i].Inlined {
+			if ic.Name == "" || seen[ic.Name] {
+				continue
+			}
+			seen[ic.Name] = true
+			r = append(r, Function{Name: ic.Name})
+		}
+	}
+	return r
+}
+
+// SpliceInlined copies the graph of each inlined function into the graph
+// of its caller, at the call expression, and updates the successors of
+// all lines accordingly. Each call site gets its own copy of the graph of
+// the callee, with the calls inlined into that copy of the callee spliced
+// first, so that the graphs of callees, which several callers share, are
+// never modified.
+func (s *Successors) SpliceInlined(funcs []Function) {
+	graphs := map[string]*Graph{}
+	for _, g := range s.Graphs {
+		graphs[g.Name] = g.clone()
+	}
+
+	for i := range funcs {
+		fn := &funcs[i]
+		if fn.Graph == nil || len(fn.Inlined) == 0 {
+			continue
+		}
+		children := map[*InlinedCall][]*InlinedCall{}
+		for _, ic := range fn.Inlined {
+			children[ic.Parent] = append(children[ic.Parent], ic)
+		}
+
+		var inline func(caller *Graph, ics []*InlinedCall)
+		inline = func(caller *Graph, ics []*InlinedCall) {
+			// calls of the same function on the same line can not be told
+			// apart, they share a copy with the calls inlined in any of them
+			type site struct {
+				name     string
+				callSite Pos
+			}
+			sites := []site{}
+			nested := map[site][]*InlinedCall{}
+			for _, ic := range ics {
+				k := site{ic.Name, ic.CallSite}
+				if _, ok := nested[k]; !ok {
+					sites = append(sites, k)
+				}
+				nested[k] = append(nested[k], children[ic]...)
+			}
+			for _, k := range sites {
+				callee := graphs[k.name]
+				if callee == nil {
+					// no graph, for example a closure: the calls
+					// inlined into it are only added to the successors
+					inline(nil, nested[k])
+					continue
+				}
+				if caller != nil && k.name == caller.Name {
+					continue
+				}
+				var calls []*Node
+				if caller != nil {
+					calls = caller.callNodes(&InlinedCall{Name: k.name, CallSite: k.callSite})
+				}
+				if len(calls) == 0 {
+					// the call was not found, keep the successors of
+					// the lines of the callee and of its inlined calls
+					body := callee.clone()
+					inline(body, nested[k])
+					body.addTo(s)
+				}
+				for _, call := range calls {
+					body := callee.clone()
+					inline(body, nested[k])
+					caller.splice(call, body)
+				}
+			}
+			if caller != nil {
+				caller.returnToInlined()
+			}
+		}
+		inline(fn.Graph, children[nil])
+		fn.Graph.addTo(s)
+	}
+}
+
+// returnToInlined lets the return from an inlined call continue directly
+// into a following inlined call, for example in a(); b() where both a
+// and b are inlined.
+func (g *Graph) returnToInlined() {
+	type edge struct{ from, to *Node }
+	add := []edge{}
+	for _, n := range g.Nodes {
+		for _, e := range n.Out {
+			if e.Kind != EdgeInlineReturn {
+				continue
+			}
+			for _, e2 := range e.To.Out {
+				if e2.Kind == EdgeInline {
+					add = append(add, edge{n, e2.To})
+				}
+			}
+		}
+	}
+	for _, e := range add {
+		g.addEdge(e.from, e.to, EdgeInlineReturn)
+	}
+}
+
+// callNodes returns the nodes of g that contain the call described by ic.
+func (g *Graph) callNodes(ic *InlinedCall) []*Node {
+	calleeName := strings.TrimSuffix(sourceName(ic.Name), "[...]")
+	if i := strings.LastIndex(calleeName, "."); i >= 0 {
+		calleeName = calleeName[i+1:]
+	}
+
+	r := []*Node{}
+	for _, n := range g.Nodes {
+		if n.AST == nil || n.Kind == NodeInline || !containsPos(n.Lines, ic.CallSite) {
+			continue
+		}
+		found := false
+		ast.Inspect(n.AST, func(x ast.Node) bool {
+			if found {
+				return false
+			}
+			switch x := x.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.BlockStmt:
+				// only look at the header of compound statements
+				return false
+			case *ast.CallExpr:
+				found = calledName(x.Fun) == calleeName
+			}
+			return true
+		})
+		if found {
+			r = append(r, n)
+		}
+	}
+	return r
+}
+
+func calledName(fun ast.Expr) string {
+	switch fun := fun.(type) {
+	case *ast.Ident:
+		return fun.Name
+	case *ast.SelectorExpr:
+		return fun.Sel.Name
+	case *ast.IndexExpr:
+		return calledName(fun.X)
+	case *ast.IndexListExpr:
+		return calledName(fun.X)
+	case *ast.ParenExpr:
+		return calledName(fun.X)
+	}
+	return ""
+}
+
+func containsPos(v []Pos, pos Pos) bool {
+	for i := range v {
+		if v[i] == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// splice copies callee into g, after call. Returning from the copy
+// continues to call and to its successors.
+func (g *Graph) splice(call *Node, callee *Graph) {
+	copies := map[*Node]*Node{callee.Any: g.Any}
+	for _, n := range callee.Nodes {
+		if n == callee.Exit || n == callee.Any {
+			continue
+		}
+		kind := n.Kind
+		if n == callee.Entry {
+			kind = NodeInline
+		}
+		c := g.newNode(kind, n.AST, n.Group, n.Lines...)
+		c.AnyOrder = n.AnyOrder
+		copies[n] = c
+	}
+
+	after := []*Node{call}
+	for _, e := range call.Out {
+		if e.Kind != EdgeQuasi {
+			after = append(after, e.To)
+		}
+	}
+
+	for _, n := range callee.Nodes {
+		from := copies[n]
+		if from == nil {
+			continue
+		}
+		for _, e := range n.Out {
+			if e.To == callee.Exit {
+				for _, to := range after {
+					g.addEdge(from, to, EdgeInlineReturn)
+				}
+				continue
+			}
+			g.addEdge(from, copies[e.To], e.Kind)
+		}
+	}
+
+	// the first instruction of an inlined body usually belongs to its
+	// first statement rather than to the declaration of the function
+	entry := copies[callee.Entry]
+	g.addEdge(call, entry, EdgeInline)
+	seen := map[*Node]bool{entry: true}
+	for stack := []*Node{entry}; len(stack) > 0; {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, e := range n.Out {
+			if e.Kind != EdgeNext || seen[e.To] {
+				continue
+			}
+			seen[e.To] = true
+			g.addEdge(call, e.To, EdgeInline)
+			if e.To.Kind == NodeBrace {
+				stack = append(stack, e.To)
+			}
+		}
+	}
+}
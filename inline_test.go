@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const inlineSrc = `package main
+
+func h(x int) int {
+	return x + 1
+}
+
+func g(x int) int {
+	y := h(x)
+	return y * 2
+}
+
+func f1(x int) int {
+	return g(x)
+}
+
+func f2(x int) int {
+	a := g(x)
+	return a
+}
+`
+
+func TestSpliceInlined(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inl.go")
+	if err := os.WriteFile(path, []byte(inlineSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inlined := func(line int) []*InlinedCall {
+		g := &InlinedCall{Name: "main.g", CallSite: Pos{path, line}}
+		h := &InlinedCall{Name: "main.h", CallSite: Pos{path, 8}, Parent: g}
+		return []*InlinedCall{g, h}
+	}
+	funcs := []Function{
+		{Name: "main.f1", Inlined: inlined(13)},
+		{Name: "main.f2", Inlined: inlined(17)},
+		{Name: "main.g"},
+		{Name: "main.h"},
+	}
+
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	nodes := map[string]int{}
+	for i := range funcs {
+		if funcs[i].Graph == nil {
+			t.Fatalf("no graph for %s", funcs[i].Name)
+		}
+		nodes[funcs[i].Name] = len(funcs[i].Graph.Nodes)
+	}
+	s.SpliceInlined(funcs)
+
+	for _, fn := range funcs[2:] {
+		if len(fn.Graph.Nodes) != nodes[fn.Name] {
+			t.Errorf("graph of callee %s modified: %d nodes, was %d", fn.Name, len(fn.Graph.Nodes), nodes[fn.Name])
+		}
+	}
+
+	for _, fn := range funcs[:2] {
+		entries := map[int]int{}
+		for _, n := range fn.Graph.Nodes {
+			if n.Kind == NodeInline {
+				entries[n.Lines[0].Line]++
+			}
+		}
+		if entries[7] != 1 || entries[3] != 1 || len(entries) != 2 {
+			t.Errorf("%s: inlined entries %v, want one copy of g (line 7) and one of h (line 3)", fn.Name, entries)
+		}
+	}
+
+	// g calls h on line 8, in the callers too
+	if !s.accepts(Pos{path, 8}, Pos{path, 4}) {
+		t.Errorf("line 4 of the inlined h is not a successor of line 8")
+	}
+
+	graphs := funcGraphs(funcs[:2])
+	if len(graphs) != 2 || graphs[0].Name != "main.f1" || graphs[1].Name != "main.f2" {
+		t.Errorf("exported graphs include callees")
+	}
+
+	// the return of g continues on line 18 in f2 only
+	ret, next := Pos{path, 9}, Pos{path, 18}
+	if s.accepts(ret, next) || s.acceptsIn(funcs[0].Graph, ret, next) || !s.acceptsIn(funcs[1].Graph, ret, next) {
+		t.Errorf("return of the inlined g continues to line 18 outside of f2")
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"debug/dwarf"
+	"go/ast"
+	"strings"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Instrumentation is a set of kinds of code the compiler inserts in the
+// functions it compiles with -race, -cover, -asan or -msan.
+type Instrumentation uint8
+
+const (
+	InstrRace  Instrumentation = 1 << iota // calls of runtime.race*
+	InstrCover                             // increments of coverage counters
+	InstrASan                              // calls of runtime.asan*
+	InstrMSan                              // calls of runtime.msan*
+)
+
+var instrumentationNames = [...]string{"race", "cover", "asan", "msan"}
+
+func (in Instrumentation) String() string {
+	v := []string{}
+	for i, name := range instrumentationNames {
+		if in&(1<<i) != 0 {
+			v = append(v, name)
+		}
+	}
+	if len(v) == 0 {
+		return "none"
+	}
+	return strings.Join(v, ", ")
+}
+
+// Instrumentation returns the instrumentation of the executable, found
+// from the functions of the runtime used by instrumented code and from the
+// coverage counters.
+func (exe *Executable) Instrumentation() Instrumentation {
+	var r Instrumentation
+	if _, ok := exe.symbols["runtime.racefuncenter"]; ok {
+		r |= InstrRace
+	}
+	if start, end := exe.coverCounters(); start < end {
+		r |= InstrCover
+	}
+	if _, ok := exe.symbols["runtime.asanread"]; ok {
+		r |= InstrASan
+	}
+	if _, ok := exe.symbols["runtime.msanread"]; ok {
+		r |= InstrMSan
+	}
+	return r
+}
+
+// coverCounters returns the range of addresses of the coverage counters,
+// the linker puts the counters of all packages between runtime.covctrs
+// and runtime.ecovctrs.
+func (exe *Executable) coverCounters() (start, end uint64) {
+	return exe.symbols["runtime.covctrs"], exe.symbols["runtime.ecovctrs"]
+}
+
+// instrumentationAt returns the instrumentation of the function with
+// entry point pc. Packages are instrumented for the race detector and the
+// sanitizers unless the runtime excludes them, the DWARF producer of the
+// compile unit lists the flags the package was compiled with:
+//
+//	Go cmd/compile go1.22.0; -race regabi
+//
+// if it does not list any flags the instrumentation of the executable is
+// used. Coverage counters are recognized by their address. The runtime is
+// never instrumented.
+func (exe *Executable) instrumentationAt(pc uint64) Instrumentation {
+	if fn := exe.Gosym.PCToFunc(pc); fn != nil {
+		if pkg := fn.PackageName(); pkg == "runtime" || strings.HasPrefix(pkg, "internal/runtime/") {
+			// never instrumented, calls the race detector explicitly
+			return 0
+		}
+	}
+	all := exe.Instrumentation()
+	if all&^InstrCover == 0 {
+		return all
+	}
+	if exe.subprograms == nil {
+		exe.readSubprograms()
+	}
+	off, ok := exe.subprograms[pc]
+	if !ok {
+		return all
+	}
+	in, cached := exe.instrumentation[off[0]]
+	if !cached {
+		rdr := exe.Data.Reader()
+		rdr.Seek(off[0])
+		cu, err := rdr.Next()
+		must(err)
+		in = all &^ InstrCover
+		if producer, _ := cu.Val(dwarf.AttrProducer).(string); strings.Contains(producer, ";") {
+			in = producerInstrumentation(producer)
+		}
+		if exe.instrumentation == nil {
+			exe.instrumentation = make(map[dwarf.Offset]Instrumentation)
+		}
+		exe.instrumentation[off[0]] = in
+	}
+	return in | all&InstrCover
+}
+
+func producerInstrumentation(producer string) Instrumentation {
+	var r Instrumentation
+	for _, flag := range strings.Fields(producer[strings.Index(producer, ";")+1:]) {
+		switch flag {
+		case "-race":
+			r |= InstrRace
+		case "-asan":
+			r |= InstrASan
+		case "-msan":
+			r |= InstrMSan
+		}
+	}
+	return r
+}
+
+// isCoverCounter returns true if inst writes a coverage counter.
+func (exe *Executable) isCoverCounter(inst AsmInstruction) bool {
+	mem, ok := inst.Inst.Args[0].(x86asm.Mem)
+	if !ok || mem.Base != x86asm.RIP {
+		return false
+	}
+	start, end := exe.coverCounters()
+	addr := inst.Pc + uint64(inst.Inst.Len) + uint64(mem.Disp)
+	return addr >= start && addr < end
+}
+
+// isAtomicCoverCounter returns true if the instruction at index i, part of
+// b, updates a coverage counter in atomic mode, used with -race: a call of
+// sync/atomic.AddUint32 or sync/atomic.StoreUint32 with the address of the
+// counter in AX.
+func (bg *BlockGraph) isAtomicCoverCounter(exe *Executable, b *Block, i int) bool {
+	name, _, ok := callTarget(exe, bg.Text[i])
+	if !ok || (name != "sync/atomic.AddUint32" && name != "sync/atomic.StoreUint32") {
+		return false
+	}
+	addr, ok := bg.regValue(exe, b, i, x86asm.RAX)
+	start, end := exe.coverCounters()
+	return ok && addr >= start && addr < end
+}
+
+// instrumentationCall returns the kind of the call of the function name,
+// in a function with instrumentation in.
+func instrumentationCall(in Instrumentation, name string) HelperKind {
+	if in&InstrRace != 0 {
+		switch name {
+		case "runtime.racefuncenter", "runtime.racefuncenterfp":
+			return HelperRaceEnter
+		case "runtime.racefuncexit":
+			return HelperRaceExit
+		case "runtime.raceread", "runtime.racewrite", "runtime.racereadrange", "runtime.racewriterange":
+			return HelperAccess
+		}
+	}
+	if in&InstrASan != 0 && (name == "runtime.asanread" || name == "runtime.asanwrite") {
+		return HelperAccess
+	}
+	if in&InstrMSan != 0 && (name == "runtime.msanread" || name == "runtime.msanwrite" || name == "runtime.msanmove") {
+		return HelperAccess
+	}
+	return HelperNone
+}
+
+// loadsArg returns true if inst loads a register used by target, an
+// instrumentation instruction: the arguments of a call, passed in AX and
+// BX, or the value stored to a coverage counter.
+func loadsArg(inst, target x86asm.Inst) bool {
+	if !isRegLoad(inst) {
+		return false
+	}
+	if target.Op == x86asm.CALL {
+		switch inst.Args[0] {
+		case x86asm.RAX, x86asm.EAX, x86asm.RBX, x86asm.EBX:
+			return true
+		}
+		return false
+	}
+	return inst.Args[0] == target.Args[1]
+}
+
+// labelInstrumentation labels the code inserted by the compiler to
+// instrument the function, if the function is instrumented, see
+// instrumentationAt: the calls of runtime.racefuncenter and
+// runtime.racefuncexit, the calls checking memory accesses for the race
+// detector and the sanitizers and the increments of coverage counters,
+// each with the loads of the registers it uses right before it:
+//
+//	LEAQ main.table(SB), AX			MOVL $0x1, counter(SB)
+//	CALL runtime.raceread(SB)
+//
+// With -race the counters are updated atomically:
+//
+//	LEAQ counter(SB), AX
+//	MOVL $0x1, BX
+//	CALL sync/atomic.AddUint32(SB)
+func (bg *BlockGraph) labelInstrumentation(exe *Executable) {
+	text := bg.Text
+	if len(text) == 0 {
+		return
+	}
+	in := exe.instrumentationAt(text[0].Pc)
+	if in == 0 {
+		return
+	}
+	for _, b := range bg.Blocks {
+		for i := b.Start; i < b.End; i++ {
+			switch text[i].Helper {
+			case HelperNone, HelperSpill, HelperRestore:
+			default:
+				continue
+			}
+			kind := HelperNone
+			if in&InstrCover != 0 && (exe.isCoverCounter(text[i]) || bg.isAtomicCoverCounter(exe, b, i)) {
+				kind = HelperCover
+			} else if name, _, ok := callTarget(exe, text[i]); ok {
+				kind = instrumentationCall(in, name)
+			}
+			if kind == HelperNone {
+				continue
+			}
+			text[i].Helper = kind
+			for j := i - 1; j >= b.Start && loadsArg(text[j].Inst, text[i].Inst); j-- {
+				text[j].Helper = kind
+			}
+		}
+	}
+}
+
+// accessAfter returns the first instruction following the i-th
+// instruction, part of b, that accesses memory or calls a function,
+// skipping helper sequences. It stops at the next access check.
+func (bg *BlockGraph) accessAfter(b *Block, i int) (AsmInstruction, bool) {
+	for j := i + 1; j < b.End; j++ {
+		inst := bg.Text[j]
+		if inst.Helper == HelperAccess && inst.Inst.Op == x86asm.CALL {
+			break
+		}
+		if inst.Helper != HelperNone {
+			continue
+		}
+		switch inst.Inst.Op {
+		case x86asm.CALL:
+			return inst, true
+		case x86asm.LEA, x86asm.NOP:
+			continue
+		}
+		for _, arg := range inst.Inst.Args {
+			if _, ismem := arg.(x86asm.Mem); ismem {
+				return inst, true
+			}
+		}
+	}
+	return AsmInstruction{}, false
+}
+
+// codeBefore returns the instruction preceding the access check at index
+// i, part of b, that is not a spill or a restore: usually the load of the
+// address checked. If there is none in b it is looked for in the
+// predecessor of b, if b has only one.
+func (bg *BlockGraph) codeBefore(b *Block, i int) (AsmInstruction, bool) {
+	for k := 0; k < 2; k++ {
+		for j := i - 1; j >= b.Start; j-- {
+			if h := bg.Text[j].Helper; h != HelperSpill && h != HelperRestore {
+				return bg.Text[j], true
+			}
+		}
+		if len(b.In) != 1 {
+			break
+		}
+		b = b.In[0].From
+		i = b.End
+	}
+	return AsmInstruction{}, false
+}
+
+// sameFrameLine returns true if inst is on the line of other, or belongs
+// to a function inlined on the line of other.
+func sameFrameLine(inst, other AsmInstruction) bool {
+	pos, ic := inst.Pos, inst.Inlined
+	for ic != nil && ic != other.Inlined {
+		pos, ic = ic.CallSite, ic.Parent
+	}
+	return ic == other.Inlined && pos == other.Pos
+}
+
+// returnLines returns the lines of the return statements of x and the
+// line of its closing brace.
+func returnLines(x *ast.FuncDecl, succs *Successors) map[Pos]bool {
+	r := map[Pos]bool{succs.ToPos(x.Body.Rbrace): true}
+	ast.Inspect(x.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			r[succs.ToPos(n.Pos())] = true
+		}
+		return true
+	})
+	return r
+}
+
+// coverBlockLines returns the lines where the blocks of x counted by the
+// coverage instrumentation begin: opening braces, colons of case and comm
+// clauses, else branches and statements following one that ends a block.
+// Blocks are further split at lines without code, each part gets its own
+// counter. Like cmd/cover, lines containing only braces are not code.
+// Older versions of cmd/cover do not split blocks, their counters are at
+// the beginning of the first part and are accepted as well.
+func coverBlockLines(x *ast.FuncDecl, succs *Successors) map[Pos]bool {
+	r := map[Pos]bool{}
+	ast.Inspect(x.Body, func(n ast.Node) bool {
+		var list []ast.Stmt
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BlockStmt:
+			r[succs.ToPos(n.Lbrace)] = true
+			list = n.List
+		case *ast.CaseClause:
+			r[succs.ToPos(n.Colon)] = true
+			list = n.Body
+		case *ast.CommClause:
+			r[succs.ToPos(n.Colon)] = true
+			list = n.Body
+		case *ast.IfStmt:
+			if n.Else != nil {
+				r[succs.ToPos(n.Else.Pos())] = true
+			}
+		}
+		for k := range list {
+			if _, labeled := list[k].(*ast.LabeledStmt); labeled || (k > 0 && endsCoverBlock(list[k-1])) {
+				r[succs.ToPos(list[k].Pos())] = true
+			}
+		}
+		return true
+	})
+
+	start, end := succs.ToPos(x.Body.Lbrace), succs.ToPos(x.Body.Rbrace)
+	lines := succs.Lines[start.File]
+	for l := start.Line + 1; l <= end.Line && l < len(lines); l++ {
+		if lines[l] == LineCode && lines[l-1] != LineCode {
+			r[Pos{start.File, l}] = true
+		}
+	}
+	return r
+}
+
+// endsCoverBlock returns true if the statement following s starts a new
+// block for the coverage instrumentation.
+func endsCoverBlock(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.BlockStmt, *ast.BranchStmt, *ast.ForStmt, *ast.IfStmt, *ast.LabeledStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt:
+		return true
+	case *ast.ExprStmt:
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "panic" {
+				return true
+			}
+		}
+	}
+	// the body of a function literal is a block of its own
+	found := false
+	ast.Inspect(s, func(n ast.Node) bool {
+		if _, ok := n.(*ast.FuncLit); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// checkInstrumentation checks the lines of the code inserted to
+// instrument fn, see labelInstrumentation. The call of
+// runtime.racefuncenter must be attributed to the declaration of fn and
+// the calls of runtime.racefuncexit to a return statement or the closing
+// brace. A call checking a memory access must be attributed to the line
+// the race detector and the sanitizers report for the access: the line of
+// the code loading the address, right before the check, or of the
+// access itself, the first instruction following the check that accesses
+// memory or makes a call, or of the call of the inlined function making
+// it. The compiler can remove the copies of values checked by
+// racereadrange, leaving only the later accesses to their fields. A
+// coverage counter must be attributed to the line where the block it
+// counts begins. The lines of the calls of racefuncenter and racefuncexit
+// and of the coverage counters are only checked outside of inlined calls,
+// access checks are checked everywhere.
+func checkInstrumentation(fn *Function, bg *BlockGraph, succs *Successors) int {
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok {
+		return 0
+	}
+	decl := succs.ToPos(x.Pos())
+	returns := returnLines(x, succs)
+	blocks := coverBlockLines(x, succs)
+
+	penalty := 0
+	for _, b := range bg.Blocks {
+		if !bg.Reachable(b) || b.Morestack {
+			continue
+		}
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			problem := ""
+			switch {
+			case inst.Helper == HelperCover:
+				if i > b.Start && fn.Text[i-1].Helper == HelperCover && fn.Text[i-1].Pos == inst.Pos {
+					continue
+				}
+				if inst.Inlined == nil && !blocks[inst.Pos] {
+					problem = "coverage counter attributed to a line that does not begin a block"
+				}
+			case inst.Inst.Op != x86asm.CALL:
+				continue
+			case inst.Helper == HelperRaceEnter:
+				if inst.Inlined == nil && inst.Pos != decl {
+					problem = "racefuncenter not attributed to the declaration of " + fn.Name
+				}
+			case inst.Helper == HelperRaceExit:
+				if inst.Inlined == nil && !returns[inst.Pos] {
+					problem = "racefuncexit attributed to a line without a return statement"
+				}
+			case inst.Helper == HelperAccess:
+				access, after := bg.accessAfter(b, i)
+				before, hasBefore := bg.codeBefore(b, i)
+				if after && !sameFrameLine(access, inst) && (!hasBefore || !sameFrameLine(before, inst)) {
+					problem = "access check attributed to a different line than the access at " + stopString(access.Stop())
+				}
+			}
+			if problem != "" {
+				printf(C, "%s %#x: %s\n", inst.Helper, inst.Pc, problem)
+				report(CatInstrumentation, inst.Pos, inst.Pc, "%s", problem)
+				penalty += InstrumentationPenalty
+			}
+		}
+	}
+	return penalty
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"debug/gosym"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+const coverSrc = `package main
+
+func f(v []int) int {
+	n := 0
+	for _, x := range v {
+		if x < 0 {
+			panic("negative")
+		}
+		n += x
+	}
+	m := map[string]int{
+		"n": n,
+	}
+	g := func() int { return m["n"] }
+
+	// comment
+	switch n {
+	case 0:
+		return 0
+	}
+	if n > 10 {
+		n = 10
+	} else {
+		n++
+	}
+	return n + g()
+}
+`
+
+func TestCoverBlockLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cover.go")
+	if err := os.WriteFile(path, []byte(coverSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	funcs := []Function{{Name: "main.f"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	x, ok := funcs[0].Decl.(*ast.FuncDecl)
+	if !ok {
+		t.Fatal("no declaration for main.f")
+	}
+
+	// 5: body of for, 6: body of if, 9: after if, 11: after for, 14:
+	// after the line with the closing brace of the map literal, 17: after
+	// the function literal, 18: case, 21: after switch and body of if,
+	// 23: else, 26: after if
+	want := []int{3, 5, 6, 9, 11, 14, 17, 18, 21, 23, 26}
+	lines := []int{}
+	for pos := range coverBlockLines(x, &s) {
+		lines = append(lines, pos.Line)
+	}
+	sort.Ints(lines)
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("blocks begin at lines %v, want %v", lines, want)
+	}
+}
+
+func TestProducerInstrumentation(t *testing.T) {
+	for _, tc := range []struct {
+		producer string
+		want     Instrumentation
+	}{
+		{"Go cmd/compile go1.22.0; regabi", 0},
+		{"Go cmd/compile go1.22.0; -race regabi", InstrRace},
+		{"Go cmd/compile go1.22.0; -asan -msan", InstrASan | InstrMSan},
+		{"Go cmd/compile go1.22.0; -shared -race", InstrRace},
+	} {
+		if got := producerInstrumentation(tc.producer); got != tc.want {
+			t.Errorf("%q: %s, want %s", tc.producer, got, tc.want)
+		}
+	}
+}
+
+func TestLabelCoverCounters(t *testing.T) {
+	exe := &Executable{
+		Gosym: &gosym.Table{Funcs: []gosym.Func{
+			{Entry: 0x1000, End: 0x1100, Sym: &gosym.Sym{Name: "main.f"}},
+			{Entry: 0x2000, End: 0x2100, Sym: &gosym.Sym{Name: "sync/atomic.AddUint32"}},
+			{Entry: 0x2100, End: 0x2200, Sym: &gosym.Sym{Name: "sync/atomic.StoreUint32"}},
+		}},
+		symbols: map[string]uint64{"runtime.covctrs": 0x8000, "runtime.ecovctrs": 0x8100},
+	}
+	inst := func(op x86asm.Op, args ...x86asm.Arg) x86asm.Inst {
+		var a x86asm.Args
+		copy(a[:], args)
+		return x86asm.Inst{Op: op, Args: a}
+	}
+	// the instructions have no length, the address of a RIP relative
+	// operand of the instruction at index i is 0x1000+i+disp
+	counter := func(i int, addr int64) x86asm.Mem {
+		return x86asm.Mem{Base: x86asm.RIP, Disp: addr - 0x1000 - int64(i)}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		text  []x86asm.Inst
+		cover []bool
+	}{
+		{
+			"counter",
+			[]x86asm.Inst{inst(x86asm.MOV, x86asm.RCX, x86asm.RAX), inst(x86asm.MOV, counter(1, 0x8004), x86asm.Imm(1))},
+			[]bool{false, true},
+		},
+		{
+			"atomic counter",
+			[]x86asm.Inst{
+				inst(x86asm.MOV, x86asm.RCX, counter(0, 0x9000)),
+				inst(x86asm.LEA, x86asm.RAX, counter(1, 0x8004)), inst(x86asm.MOV, x86asm.EBX, x86asm.Imm(1)), inst(x86asm.CALL, x86asm.Imm(0x2000)),
+			},
+			[]bool{false, true, true, true},
+		},
+		{
+			"atomic store of a counter",
+			[]x86asm.Inst{inst(x86asm.LEA, x86asm.RAX, counter(0, 0x8000)), inst(x86asm.MOV, x86asm.EBX, x86asm.Imm(6)), inst(x86asm.CALL, x86asm.Imm(0x2100))},
+			[]bool{true, true, true},
+		},
+		{
+			"atomic add of a variable",
+			[]x86asm.Inst{inst(x86asm.LEA, x86asm.RAX, counter(0, 0x9000)), inst(x86asm.MOV, x86asm.EBX, x86asm.Imm(1)), inst(x86asm.CALL, x86asm.Imm(0x2000))},
+			[]bool{false, false, false},
+		},
+	} {
+		text := make([]AsmInstruction, len(tc.text))
+		for i := range tc.text {
+			text[i] = AsmInstruction{Inst: tc.text[i], Pc: 0x1000 + uint64(i)}
+		}
+		bg := NewBlockGraph(text, exe)
+		for i := range text {
+			if got := bg.Text[i].Helper == HelperCover; got != tc.cover[i] {
+				t.Errorf("%s: instruction %d cover %v, want %v", tc.name, i, got, tc.cover[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+)
+
+// LineKind classifies a line of a source file.
+type LineKind uint8
+
+const (
+	LineBlank   LineKind = iota // only white space
+	LineComment                 // comments, without any other token
+	LineBrace                   // braces and comments, without any other token
+	LineCode                    // at least one token that is not a brace or a comment
+)
+
+var lineKindNames = [...]string{"blank", "comment", "brace", "code"}
+
+func (k LineKind) String() string {
+	return lineKindNames[k]
+}
+
+// classifyLines returns the kind of each line of src, indexed by line
+// number: r[0] is unused. Tokens spanning several lines, like raw strings
+// and block comments, give their kind to all of them.
+func classifyLines(path string, src []byte) []LineKind {
+	var fset token.FileSet
+	file := fset.AddFile(path, -1, len(src))
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, scanner.ScanComments)
+	r := make([]LineKind, bytes.Count(src, []byte{'\n'})+2)
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			// automatically inserted
+			continue
+		}
+		kind := LineCode
+		switch tok {
+		case token.COMMENT:
+			kind = LineComment
+		case token.LBRACE, token.RBRACE:
+			kind = LineBrace
+		}
+		start := file.Line(pos)
+		end := start
+		if len(lit) > 0 {
+			end = file.Line(pos + token.Pos(len(lit)-1))
+		}
+		for l := start; l <= end; l++ {
+			if kind > r[l] {
+				r[l] = kind
+			}
+		}
+	}
+	return r
+}
+
+// checkLines reports the instructions of fn attributed to lines that can
+// never have code: blank lines, lines containing only comments, lines past
+// the end of their file and, for instructions that do not belong to an
+// inlined call, lines outside of the declaration of fn, in its file or in
+// another one. The last ones are only reported when the line is not part
+// of a function inlined in fn either, the address ranges of inlined calls
+// in DWARF can leave out some of their instructions. Each sequence of
+// instructions attributed to the same line is reported once, lines of
+// files that were not parsed, like <autogenerated>, are not checked.
+func checkLines(fn *Function, succs *Successors) int {
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok {
+		return 0
+	}
+	start, end := succs.ToPos(x.Pos()), succs.ToPos(x.End())
+	inlined := succs.inlinedDecls(fn)
+
+	penalty := 0
+	for i, inst := range fn.Text {
+		if inst.Padding || inst.Undecodable || inst.Pos.Line <= 0 {
+			continue
+		}
+		if i > 0 && fn.Text[i-1].Pos == inst.Pos && fn.Text[i-1].Inlined == inst.Inlined {
+			continue
+		}
+		lines, parsed := succs.Lines[inst.Pos.File]
+		if !parsed {
+			continue
+		}
+		var what string
+		switch {
+		case inst.Pos.Line >= len(lines):
+			what = "a line past the end of the file"
+		case lines[inst.Pos.Line] < LineBrace:
+			what = "a " + lines[inst.Pos.Line].String() + " line"
+		case inst.Inlined == nil && inst.Pos.File == start.File && (inst.Pos.Line < start.Line || inst.Pos.Line > end.Line) && !inDecl(inlined, inst.Pos):
+			what = "a line outside of " + fn.Name
+		case inst.Inlined == nil && inst.Pos.File != start.File && !inDecl(inlined, inst.Pos):
+			what = "a line of another file than " + fn.Name
+		}
+		if what != "" {
+			report(CatImpossible, inst.Pos, inst.Pc, "instruction attributed to %s", what)
+			penalty += ImpossiblePenalty
+		}
+	}
+	return penalty
+}
+
+// inlinedDecls returns the first and last line of the declaration of each
+// function inlined in fn that has a graph.
+func (s *Successors) inlinedDecls(fn *Function) [][2]Pos {
+	names := map[string]bool{}
+	for _, ic := range fn.Inlined {
+		names[ic.Name] = true
+	}
+	r := [][2]Pos{}
+	for _, g := range s.Graphs {
+		if !names[g.Name] || g.Entry == nil || g.Entry.AST == nil {
+			continue
+		}
+		r = append(r, [2]Pos{s.ToPos(g.Entry.AST.Pos()), s.ToPos(g.Entry.AST.End())})
+	}
+	return r
+}
+
+// inDecl returns true if pos is inside one of decls.
+func inDecl(decls [][2]Pos, pos Pos) bool {
+	for _, d := range decls {
+		if pos.File == d[0].File && pos.Line >= d[0].Line && pos.Line <= d[1].Line {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const linesSrc = `package main
+
+// lower returns the lower case
+// of c.
+func lower(c byte) byte {
+	return c | ('x' - 'X')
+}
+
+func f(s string) string {
+	b := []byte(s)
+
+	for i := range b {
+		b[i] = lower(b[i]) /* comment */
+	}
+	return ` + "`raw\n\nstring`" + `
+}
+`
+
+const otherSrc = `package main
+
+func upper(c byte) byte {
+	return c &^ ('x' - 'X')
+}
+
+func g() {
+	println("g")
+}
+`
+
+func TestClassifyLines(t *testing.T) {
+	lines := classifyLines("a.go", []byte(linesSrc))
+	for _, tc := range []struct {
+		line int
+		want LineKind
+	}{
+		{1, LineCode},
+		{2, LineBlank},
+		{3, LineComment},
+		{4, LineComment},
+		{5, LineCode},
+		{7, LineBrace},
+		{11, LineBlank},
+		{13, LineCode}, // code followed by a comment
+		{15, LineCode}, // raw string
+		{16, LineCode}, // blank line inside a raw string
+		{17, LineCode},
+		{14, LineBrace},
+		{18, LineBrace},
+		{19, LineBlank}, // past the final newline
+	} {
+		if lines[tc.line] != tc.want {
+			t.Errorf("line %d: %s, want %s", tc.line, lines[tc.line], tc.want)
+		}
+	}
+}
+
+func TestCheckLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines.go")
+	if err := os.WriteFile(path, []byte(linesSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(filepath.Dir(path), "other.go")
+	if err := os.WriteFile(other, []byte(otherSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ic := &InlinedCall{Name: "main.lower", CallSite: Pos{path, 13}}
+	ic2 := &InlinedCall{Name: "main.upper", CallSite: Pos{path, 13}}
+	funcs := []Function{{Name: "main.f", Inlined: []*InlinedCall{ic, ic2}}, {Name: "main.lower"}, {Name: "main.upper"}, {Name: "main.g"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	s.FindSuccessors(other, []string{"main"}, funcs)
+	fn := &funcs[0]
+	if fn.Decl == nil {
+		t.Fatal("no declaration for main.f")
+	}
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	simpleOutput, complexOutput = devnull, devnull
+	defer func() { simpleOutput, complexOutput, counts = nil, nil, Counts{} }()
+
+	for _, tc := range []struct {
+		name    string
+		pos     Pos
+		inlined *InlinedCall
+		bad     bool
+	}{
+		{"code", Pos{path, 13}, nil, false},
+		{"inlined", Pos{path, 6}, ic, false},
+		{"gap in the range of an inlined call", Pos{path, 6}, nil, false},
+		{"outside of the function", Pos{path, 1}, nil, true},
+		{"blank", Pos{path, 11}, nil, true},
+		{"comment of an inlined function", Pos{path, 3}, ic, true},
+		{"past the end", Pos{path, 30}, nil, true},
+		{"file not parsed", Pos{"<autogenerated>", 1}, nil, false},
+		{"function inlined from another file", Pos{other, 4}, ic2, false},
+		{"gap in an inlined call from another file", Pos{other, 4}, nil, false},
+		{"another file", Pos{other, 8}, nil, true},
+	} {
+		fn.Text = []AsmInstruction{{Pc: 0x1000, Pos: tc.pos, Inlined: tc.inlined}}
+		if got := checkLines(fn, &s) != 0; got != tc.bad {
+			t.Errorf("%s: reported %v, want %v", tc.name, got, tc.bad)
+		}
+	}
+}
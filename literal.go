@@ -0,0 +1,243 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// maxLiteralElements is the maximum number of elements of composite
+// literals in a single statement that are modeled in evaluation order,
+// statements with more elements are treated as a single node.
+const maxLiteralElements = 256
+
+// Simple creates the nodes for the simple statement (or expression) x.
+// The elements of composite literals spanning multiple lines get a node
+// each and can only be executed in evaluation order, all other lines of x
+// belong to the head node. Lines made only of constants are expected to
+// have no code, they are recorded in NoCode and belong to the head node.
+// Entry are the nodes execution can start from, exit the nodes it can
+// leave x from.
+func (b *Builder) Simple(kind NodeKind, x ast.Node) (head *Node, entry, exit Frontier) {
+	lines := b.Positions(x)
+	nocode := b.constantLines(x, lines)
+	for _, pos := range lines {
+		if nocode[pos] {
+			b.g.NoCode = append(b.g.NoCode, pos)
+		}
+	}
+
+	groups := [][]Pos{}
+	ingroup := map[Pos]bool{}
+	ast.Inspect(x, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CompositeLit:
+			if b.Pos(n.Lbrace).Line == b.Pos(n.Rbrace).Line {
+				return true
+			}
+			first, last := b.Pos(n.Lbrace), b.Pos(n.Rbrace)
+			for _, elt := range n.Elts {
+				group := []Pos{}
+				for _, pos := range b.Positions(elt) {
+					if pos != first && pos != last && !nocode[pos] && !ingroup[pos] {
+						group = append(group, pos)
+						ingroup[pos] = true
+					}
+				}
+				if len(group) > 0 {
+					groups = append(groups, group)
+				}
+			}
+			return false
+		}
+		return true
+	})
+
+	if len(groups) > maxLiteralElements {
+		groups = nil
+		ingroup = map[Pos]bool{}
+	}
+
+	headLines := []Pos{}
+	for _, pos := range lines {
+		if !ingroup[pos] {
+			headLines = append(headLines, pos)
+		}
+	}
+	head = b.Node(kind, x, headLines...)
+	entry = Frontier{head}
+	exit = Frontier{head}
+
+	elts := make([]*Node, len(groups))
+	for i := range groups {
+		elts[i] = b.Node(NodeExpr, x, groups[i]...)
+		elts[i].AnyOrder = true
+		b.AddEdge(head, elts[i], EdgeNext)
+		b.AddEdge(elts[i], head, EdgeNext)
+		for j := 0; j < i; j++ {
+			b.AddEdge(elts[j], elts[i], EdgeNext)
+		}
+		exit = append(exit, elts[i])
+	}
+	if len(elts) > 0 {
+		entry = append(entry, elts[0])
+	}
+	return head, entry, exit
+}
+
+// constantLines returns the lines of x, except the first one, that only
+// contain constants belonging to static data. Only the elements of slice
+// literals, and of the literals nested in them, are stored as static data:
+// the elements of maps, of addressed literals and of arrays and structs
+// built on the stack are assigned by code attributed to their lines.
+func (b *Builder) constantLines(x ast.Node, lines []Pos) map[Pos]bool {
+	type lineInfo struct {
+		leaves, consts int
+		code           bool
+	}
+	info := map[Pos]*lineInfo{}
+	get := func(p token.Pos) *lineInfo {
+		pos := b.Pos(p)
+		if info[pos] == nil {
+			info[pos] = &lineInfo{}
+		}
+		return info[pos]
+	}
+	leaf := func(p token.Pos, isconst bool) {
+		li := get(p)
+		li.leaves++
+		if isconst {
+			li.consts++
+		}
+	}
+	allCode := func(n ast.Node) {
+		for p := n.Pos(); p < n.End(); p++ {
+			get(p).code = true
+		}
+	}
+
+	var visit func(n ast.Node) bool
+	var literal func(n *ast.CompositeLit, typ ast.Expr, static bool)
+	visit = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			allCode(n)
+			return false
+		case *ast.BasicLit:
+			leaf(n.Pos(), true)
+		case *ast.Ident:
+			leaf(n.Pos(), isConstIdent(n))
+		case *ast.SelectorExpr:
+			leaf(n.Pos(), false)
+			return false
+		case *ast.CallExpr:
+			get(n.Lparen).code = true
+			get(n.Rparen).code = true
+		case *ast.IndexExpr:
+			get(n.Lbrack).code = true
+		case *ast.UnaryExpr:
+			if n.Op == token.AND {
+				get(n.OpPos).code = true
+				if lit, ok := n.X.(*ast.CompositeLit); ok {
+					allCode(lit)
+					return false
+				}
+			}
+		case *ast.CompositeLit:
+			literal(n, n.Type, false)
+			return false
+		}
+		return true
+	}
+	literal = func(n *ast.CompositeLit, typ ast.Expr, static bool) {
+		if n.Type != nil {
+			typ = n.Type
+		}
+		var elt ast.Expr
+		isstruct := false
+		switch t := literalType(typ).(type) {
+		case *ast.ArrayType:
+			elt = t.Elt
+			if t.Len == nil {
+				// slices are allocated
+				get(n.Lbrace).code = true
+				static = true
+			}
+		case *ast.StructType:
+			isstruct = true
+		default:
+			// maps, elided addressed literals and types declared elsewhere
+			static = false
+		}
+		if !static {
+			allCode(n)
+			return
+		}
+		for _, e := range n.Elts {
+			if kv, ok := e.(*ast.KeyValueExpr); ok {
+				if key, ok := kv.Key.(*ast.Ident); ok && isstruct {
+					// field name
+					leaf(key.Pos(), true)
+				} else {
+					ast.Inspect(kv.Key, visit)
+				}
+				e = kv.Value
+			}
+			if lit, ok := e.(*ast.CompositeLit); ok {
+				literal(lit, elt, true)
+			} else {
+				ast.Inspect(e, visit)
+			}
+		}
+	}
+	ast.Inspect(x, visit)
+
+	r := map[Pos]bool{}
+	for i, pos := range lines {
+		if i == 0 {
+			continue
+		}
+		if li := info[pos]; li != nil && !li.code && li.leaves > 0 && li.leaves == li.consts {
+			r[pos] = true
+		}
+	}
+	return r
+}
+
+// literalType returns the type expression of the type typ, following the
+// names of types declared in the same file, or nil if it is not known.
+func literalType(typ ast.Expr) ast.Expr {
+	for i := 0; i < 10; i++ {
+		switch t := typ.(type) {
+		case *ast.ParenExpr:
+			typ = t.X
+		case *ast.Ident:
+			if t.Obj == nil || t.Obj.Kind != ast.Typ {
+				return nil
+			}
+			spec, ok := t.Obj.Decl.(*ast.TypeSpec)
+			if !ok || spec.TypeParams != nil {
+				return nil
+			}
+			typ = spec.Type
+		default:
+			return typ
+		}
+	}
+	return nil
+}
+
+// isConstIdent returns true if id is a constant or a type. Identifiers not
+// resolved in the file, other than the predeclared constants, are assumed
+// to be variables.
+func isConstIdent(id *ast.Ident) bool {
+	if id.Obj != nil {
+		return id.Obj.Kind == ast.Con || id.Obj.Kind == ast.Typ
+	}
+	switch id.Name {
+	case "true", "false", "nil", "iota":
+		return true
+	}
+	return false
+}
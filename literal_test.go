@@ -0,0 +1,103 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const literalSrc = `package main
+
+const K = 2
+
+type T struct{ A, B int }
+
+type S []T
+
+func slice() {
+	s := []int{
+		1,
+		K,
+		global,
+	}
+}
+
+func nested() {
+	s := S{
+		{A: 1,
+			B: K},
+		{A: global,
+			B: 1},
+	}
+}
+
+func pointers() {
+	s := []*T{
+		{A: 1,
+			B: K},
+	}
+}
+
+func maps() {
+	m := map[string]int{
+		"a": 1,
+		"b": global,
+	}
+}
+
+func addressed() {
+	t := &T{
+		A: 1,
+		B: K,
+	}
+}
+
+func local() {
+	t := T{
+		A: 1,
+		B: K,
+	}
+}
+
+func array() {
+	a := []int{
+		K: 1,
+		other: 2,
+	}
+}
+`
+
+func TestConstantLines(t *testing.T) {
+	var s Successors
+	n, err := parser.ParseFile(&s.fset, "lit.go", literalSrc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]int{
+		"slice":     {11, 12},
+		"nested":    {19, 20, 22},
+		"pointers":  nil,
+		"maps":      nil,
+		"addressed": nil,
+		"local":     nil,
+		"array":     {56},
+	}
+	for _, decl := range n.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		b := &Builder{s: &s}
+		stmt := fn.Body.List[0]
+		var got []int
+		for pos := range b.constantLines(stmt, b.Positions(stmt)) {
+			got = append(got, pos.Line)
+		}
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, want[fn.Name.Name]) {
+			t.Errorf("%s: constant lines %v, want %v", fn.Name.Name, got, want[fn.Name.Name])
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"go/ast"
+	"sort"
+)
+
+// MachineLoop is a natural loop of the machine code of a function, all
+// the back edges to Header. Irreducible loops are not found.
+type MachineLoop struct {
+	Header  *Block
+	Latches []*Block        // blocks with a back edge to Header
+	Body    map[*Block]bool // includes Header
+	Exits   []*BlockEdge    // edges from Body to blocks outside of it
+}
+
+// Rotated returns true if the header of l is placed after one of its
+// latches: the compiler moves the condition of a loop after its body, so
+// that each iteration only executes one jump, and enters the loop by
+// jumping to the condition.
+func (l *MachineLoop) Rotated() bool {
+	for _, latch := range l.Latches {
+		if latch.Start < l.Header.Start {
+			return true
+		}
+	}
+	return false
+}
+
+// Dominators returns the immediate dominator of each block reachable from
+// the entry block, indexed by block ID, nil for the other blocks. The
+// entry block is its own immediate dominator. Morestack blocks are
+// ignored.
+func (bg *BlockGraph) Dominators() []*Block {
+	idom := make([]*Block, len(bg.Blocks))
+	if len(bg.Blocks) == 0 {
+		return idom
+	}
+
+	// Cooper, Harvey, Kennedy. "A Simple, Fast Dominance Algorithm"
+	order := bg.postorder()
+	index := make([]int, len(bg.Blocks))
+	for i, b := range order {
+		index[b.ID] = i
+	}
+
+	entry := bg.Blocks[0]
+	idom[entry.ID] = entry
+
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for index[a.ID] < index[b.ID] {
+				a = idom[a.ID]
+			}
+			for index[b.ID] < index[a.ID] {
+				b = idom[b.ID]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(order) - 1; i >= 0; i-- {
+			b := order[i]
+			if b == entry {
+				continue
+			}
+			var newidom *Block
+			for _, e := range b.In {
+				if e.From.Morestack || idom[e.From.ID] == nil {
+					continue
+				}
+				if newidom == nil {
+					newidom = e.From
+				} else {
+					newidom = intersect(e.From, newidom)
+				}
+			}
+			if newidom != nil && idom[b.ID] != newidom {
+				idom[b.ID] = newidom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+func (bg *BlockGraph) postorder() []*Block {
+	r := []*Block{}
+	seen := make([]bool, len(bg.Blocks))
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b.ID] = true
+		for _, e := range b.Out {
+			if !e.To.Morestack && !seen[e.To.ID] {
+				visit(e.To)
+			}
+		}
+		r = append(r, b)
+	}
+	visit(bg.Blocks[0])
+	return r
+}
+
+// blockDominates returns true if a dominates b, idom is the result of
+// Dominators.
+func blockDominates(idom []*Block, a, b *Block) bool {
+	for {
+		if a == b {
+			return true
+		}
+		next := idom[b.ID]
+		if next == nil || next == b {
+			return false
+		}
+		b = next
+	}
+}
+
+// Loops returns the loops of the machine code, in the order of their
+// headers.
+func (bg *BlockGraph) Loops() []*MachineLoop {
+	idom := bg.Dominators()
+	byHeader := map[*Block]*MachineLoop{}
+	loops := []*MachineLoop{}
+	for _, b := range bg.Blocks {
+		if idom[b.ID] == nil {
+			continue
+		}
+		for _, e := range b.Out {
+			if !blockDominates(idom, e.To, b) {
+				continue
+			}
+			loop := byHeader[e.To]
+			if loop == nil {
+				loop = &MachineLoop{Header: e.To, Body: map[*Block]bool{e.To: true}}
+				byHeader[e.To] = loop
+				loops = append(loops, loop)
+			}
+			loop.Latches = append(loop.Latches, b)
+			stack := []*Block{}
+			if !loop.Body[b] {
+				loop.Body[b] = true
+				stack = append(stack, b)
+			}
+			for len(stack) > 0 {
+				m := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				for _, e := range m.In {
+					if idom[e.From.ID] != nil && !loop.Body[e.From] {
+						loop.Body[e.From] = true
+						stack = append(stack, e.From)
+					}
+				}
+			}
+		}
+	}
+
+	for i := 1; i < len(loops); i++ {
+		for j := i; j > 0 && loops[j].Header.Start < loops[j-1].Header.Start; j-- {
+			loops[j], loops[j-1] = loops[j-1], loops[j]
+		}
+	}
+
+	for _, loop := range loops {
+		for _, b := range bg.Blocks {
+			if !loop.Body[b] {
+				continue
+			}
+			for _, e := range b.Out {
+				if !loop.Body[e.To] {
+					loop.Exits = append(loop.Exits, e)
+				}
+			}
+		}
+	}
+
+	return loops
+}
+
+// firstStop returns the index of the first stop of b that belongs to the
+// function itself, or -1.
+func (bg *BlockGraph) firstStop(b *Block) int {
+	for i := b.Start; i < b.End; i++ {
+		inst := bg.Text[i]
+		switch inst.Helper {
+		case HelperNone, HelperSpill, HelperRestore:
+			if inst.IsStmt && inst.Inlined == nil {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// sourceLoop is a for or range statement of the source.
+type sourceLoop struct {
+	*Loop
+	start, end Pos // lines spanned by the statement
+	hasCond    bool
+}
+
+func (l *sourceLoop) contains(pos Pos) bool {
+	return pos.File == l.start.File && pos.Line >= l.start.Line && pos.Line <= l.end.Line
+}
+
+// leaves returns true if pos is on a path of the source that leaves l
+// without going back to its header: a break, a return or a jump to an
+// outer loop, and the statements leading to it.
+func (l *sourceLoop) leaves(g *Graph, pos Pos) bool {
+	seen := map[*Node]bool{}
+	stack := []*Node{}
+	for _, n := range g.Nodes {
+		if n != l.Header && n.Kind != NodeInline && containsPos(n.Lines, pos) {
+			seen[n] = true
+			stack = append(stack, n)
+		}
+	}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n == g.Exit || n == g.Any || (len(n.Lines) > 0 && n.Lines[0].File == l.start.File && !l.contains(n.Lines[0])) {
+			return true
+		}
+		for _, e := range n.Out {
+			if e.Kind != EdgeInline && e.To != l.Header && !seen[e.To] {
+				seen[e.To] = true
+				stack = append(stack, e.To)
+			}
+		}
+	}
+	return false
+}
+
+// sourceLoops returns the for and range statements of fn, outer loops
+// first. Loops copied from inlined functions are skipped.
+func sourceLoops(fn *Function, succs *Successors) []*sourceLoop {
+	start, end := succs.ToPos(fn.Decl.Pos()), succs.ToPos(fn.Decl.End())
+	r := []*sourceLoop{}
+	for _, loop := range fn.Graph.Loops() {
+		sl := &sourceLoop{Loop: loop}
+		switch x := loop.Header.AST.(type) {
+		case *ast.ForStmt:
+			sl.hasCond = x.Cond != nil
+		case *ast.RangeStmt:
+			sl.hasCond = true
+		default:
+			continue
+		}
+		sl.start, sl.end = succs.ToPos(loop.Header.AST.Pos()), succs.ToPos(loop.Header.AST.End())
+		if sl.start.File != start.File || sl.start.Line < start.Line || sl.end.Line > end.Line {
+			continue
+		}
+		r = append(r, sl)
+	}
+	return r
+}
+
+// matchLoops returns the statement each machine loop of mloops was
+// compiled from: the innermost source loop containing at least half of the
+// stops of its body that belong to the function itself, and the stops in
+// effect at its back edges if one does. Inner machine loops are matched first, and a
+// source loop with a stop on its condition or post statement in the
+// header or latches of the machine loop it was matched to is not matched
+// to the machine loops containing it: the header of the machine loop of an
+// outer loop can start with the code of an inner loop. Machine loops that
+// are not nested, like the copies of a loop made by the compiler, can
+// match the same source loop. Machine loops without stops, like the copies
+// of memory, are not matched.
+func matchLoops(bg *BlockGraph, mloops []*MachineLoop, loops []*sourceLoop, in [][]Stop) map[*MachineLoop]*sourceLoop {
+	order := append([]*MachineLoop{}, mloops...)
+	sort.SliceStable(order, func(i, j int) bool { return len(order[i].Body) < len(order[j].Body) })
+
+	r := map[*MachineLoop]*sourceLoop{}
+	matched := map[*sourceLoop][]*MachineLoop{}
+	nested := func(l *MachineLoop, sl *sourceLoop) bool {
+		for _, m := range matched[sl] {
+			if l.Body[m.Header] {
+				return true
+			}
+		}
+		return false
+	}
+	for _, l := range order {
+		stops := []Pos{}
+		for b := range l.Body {
+			for i := b.Start; i < b.End; i++ {
+				inst := bg.Text[i]
+				if inst.IsStmt && inst.Inlined == nil && inst.Helper == HelperNone {
+					stops = append(stops, inst.Pos)
+				}
+			}
+		}
+		if len(stops) == 0 {
+			continue
+		}
+		var sl, fallback *sourceLoop
+		for _, c := range loops {
+			if nested(l, c) {
+				continue
+			}
+			n := 0
+			for _, pos := range stops {
+				if c.contains(pos) {
+					n++
+				}
+			}
+			if 2*n < len(stops) {
+				continue
+			}
+			if fallback == nil || fallback.containsLoop(c) {
+				fallback = c
+			}
+			if bg.latchesIn(l, c, in) && (sl == nil || sl.containsLoop(c)) {
+				sl = c
+			}
+		}
+		if sl == nil {
+			sl = fallback
+		}
+		if sl == nil {
+			continue
+		}
+		if bg.stopsOnCond(l, sl) {
+			matched[sl] = append(matched[sl], l)
+		}
+		r[l] = sl
+	}
+	return r
+}
+
+// containsLoop returns true if l2 is nested in l.
+func (l *sourceLoop) containsLoop(l2 *sourceLoop) bool {
+	return l.contains(l2.start) && l.contains(l2.end)
+}
+
+// latchesIn returns true if the stops in effect when the back edges of l
+// are taken are inside sl: the last stop of each latch that belongs to the
+// function itself, or the last stops of its predecessors, or the stops
+// execution enters them with, from in. Loads from the stack are ignored,
+// the compiler attributes them to the line using the value.
+func (bg *BlockGraph) latchesIn(l *MachineLoop, sl *sourceLoop, in [][]Stop) bool {
+	lastStop := func(b *Block) []Stop {
+		for i := b.End - 1; i >= b.Start; i-- {
+			inst := bg.Text[i]
+			if inst.IsStmt && inst.Inlined == nil && inst.Helper == HelperNone && !isStackLoad(inst.Inst) {
+				return []Stop{inst.Stop()}
+			}
+		}
+		return nil
+	}
+	for _, b := range l.Latches {
+		from := lastStop(b)
+		if from == nil {
+			for _, e := range b.In {
+				if stops := lastStop(e.From); stops != nil {
+					from = append(from, stops...)
+				} else {
+					from = append(from, in[e.From.ID]...)
+				}
+			}
+		}
+		for _, stop := range from {
+			if stop.Inlined == nil && !sl.contains(stop.Pos) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stopsOnCond returns true if the header or one of the latches of l has a
+// stop, belonging to the function itself, on the condition or the post
+// statement of sl.
+func (bg *BlockGraph) stopsOnCond(l *MachineLoop, sl *sourceLoop) bool {
+	for _, b := range append([]*Block{l.Header}, l.Latches...) {
+		for i := b.Start; i < b.End; i++ {
+			inst := bg.Text[i]
+			if inst.IsStmt && inst.Inlined == nil && containsPos(sl.Header.Lines, inst.Pos) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testedAtLatches returns true if each latch of l evaluates the condition
+// of sl and jumps back to the header of l if it is true. The compiler
+// drops the evaluation of the condition before the first iteration when
+// it is known to be true, the header of l is then the start of the body.
+func (bg *BlockGraph) testedAtLatches(l *MachineLoop, sl *sourceLoop) bool {
+	for _, latch := range l.Latches {
+		cond := false
+		for _, e := range latch.Out {
+			if e.To == l.Header && e.Kind == BlockCond {
+				cond = true
+			}
+		}
+		if !cond {
+			return false
+		}
+		found := false
+		for i := latch.Start; i < latch.End; i++ {
+			if bg.Text[i].Inlined == nil && containsPos(sl.Header.Lines, bg.Text[i].Pos) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLoops finds the loops of the machine code of fn, matches them to
+// the loops of the source and checks their header, latches and exits:
+//   - the stop in effect when the header is executed must be on the
+//     condition of the loop, for loops without a condition, or with a
+//     condition only evaluated at the end of the body, any line of the
+//     loop is accepted
+//   - the stop execution comes from when taking a back edge must be inside
+//     the loop
+//   - the first stop after leaving the loop must not be inside the loop,
+//     unless it is on a path of the source leaving the loop
+func checkLoops(fn *Function, bg *BlockGraph, in [][]Stop, succs *Successors) int {
+	if fn.Graph == nil {
+		return 0
+	}
+	loops := sourceLoops(fn, succs)
+
+	mloops := bg.Loops()
+	match := matchLoops(bg, mloops, loops, in)
+
+	penalty := 0
+	for _, l := range mloops {
+		header := bg.Text[l.Header.Start]
+		sl := match[l]
+		if sl == nil {
+			// goto loop, loop of an inlined function or copy of memory
+			printf(C, "loop %#x: no matching loop in the source\n", header.Pc)
+			continue
+		}
+		rotated := ""
+		if l.Rotated() {
+			rotated = " (rotated)"
+		}
+		printf(C, "loop %#x%s: %s:%d, %d latches, %d exits\n", header.Pc, rotated, sl.start.File, sl.start.Line, len(l.Latches), len(l.Exits))
+
+		if sl.hasCond && !bg.testedAtLatches(l, sl) {
+			cur := in[l.Header.ID]
+			if i := bg.firstStop(l.Header); i >= 0 {
+				cur = []Stop{bg.Text[i].Stop()}
+			}
+			for _, stop := range cur {
+				if stop.Inlined == nil && !containsPos(sl.Header.Lines, stop.Pos) {
+					report(CatLoop, stop.Pos, header.Pc, "header of the loop at line %d is not attributed to its condition", sl.start.Line)
+					penalty += LoopPenalty
+					break
+				}
+			}
+		}
+
+		for _, latch := range l.Latches {
+			from := in[latch.ID]
+			if i := bg.lastStop(latch); i >= 0 {
+				from = []Stop{bg.Text[i].Stop()}
+			}
+			last := bg.Text[latch.End-1]
+			for _, stop := range from {
+				if stop.Inlined == nil && !sl.contains(stop.Pos) {
+					report(CatLoop, stop.Pos, last.Pc, "back edge of the loop at line %d comes from outside of the loop", sl.start.Line)
+					penalty += LoopPenalty
+				}
+			}
+		}
+
+		for _, e := range l.Exits {
+			if e.To.Morestack || bg.Text[e.To.Start].Helper == HelperPanic {
+				continue
+			}
+			i := bg.firstStop(e.To)
+			if i < 0 {
+				continue
+			}
+			inst := bg.Text[i]
+			if sl.contains(inst.Pos) && !sl.leaves(fn.Graph, inst.Pos) {
+				report(CatLoop, inst.Pos, inst.Pc, "exit from the loop at line %d stops inside the loop", sl.start.Line)
+				penalty += LoopPenalty
+			}
+		}
+	}
+	return penalty
+}
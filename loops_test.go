@@ -0,0 +1,139 @@
+package main
+
+import (
+	"debug/gosym"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// asm is an instruction of a test function: jumps have the index of their
+// destination in to.
+type asm struct {
+	op   x86asm.Op
+	line int
+	stmt bool
+	to   int
+}
+
+func testBlockGraph(path string, code []asm) *BlockGraph {
+	text := make([]AsmInstruction, len(code))
+	for i, c := range code {
+		inst := x86asm.Inst{Op: c.op}
+		switch c.op {
+		case x86asm.JMP, x86asm.JNE, x86asm.JLE, x86asm.JGE, x86asm.JL:
+			inst.Args[0] = x86asm.Imm(0x1000 + c.to)
+		}
+		text[i] = AsmInstruction{Inst: inst, Pc: 0x1000 + uint64(i), Pos: Pos{path, c.line}, IsStmt: c.stmt}
+	}
+	return NewBlockGraph(text, &Executable{Gosym: &gosym.Table{}})
+}
+
+func TestLoops(t *testing.T) {
+	// rotated loop: the condition is placed after the body
+	bg := testBlockGraph("a.go", []asm{
+		{op: x86asm.MOV, line: 1},
+		{op: x86asm.JMP, line: 2, to: 4},
+		{op: x86asm.MOV, line: 3},
+		{op: x86asm.INC, line: 2},
+		{op: x86asm.CMP, line: 2},
+		{op: x86asm.JL, line: 2, to: 2},
+		{op: x86asm.RET, line: 4},
+	})
+	if len(bg.Blocks) != 4 {
+		t.Fatalf("%d blocks, want 4", len(bg.Blocks))
+	}
+	idom := bg.Dominators()
+	for b, want := range []int{0, 2, 0, 2} {
+		if idom[b] == nil || idom[b].ID != want {
+			t.Errorf("immediate dominator of block %d: %v, want %d", b, idom[b], want)
+		}
+	}
+
+	loops := bg.Loops()
+	if len(loops) != 1 {
+		t.Fatalf("%d loops, want 1", len(loops))
+	}
+	l := loops[0]
+	if l.Header.ID != 2 || len(l.Latches) != 1 || l.Latches[0].ID != 1 || len(l.Body) != 2 || !l.Rotated() {
+		t.Errorf("loop header %d, latches %v, body %d blocks, rotated %v", l.Header.ID, l.Latches, len(l.Body), l.Rotated())
+	}
+	if len(l.Exits) != 1 || l.Exits[0].To.ID != 3 {
+		t.Errorf("loop exits %v, want block 3", l.Exits)
+	}
+}
+
+const loopsSrc = `package main
+
+func flags(v []int) {
+	for changed := true; changed; {
+		changed = false
+		for i := 1; i < len(v); i++ {
+			if v[i-1] > v[i] {
+				changed = true
+			}
+		}
+	}
+}
+`
+
+func TestMatchLoops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loops.go")
+	if err := os.WriteFile(path, []byte(loopsSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	funcs := []Function{{Name: "main.flags"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	fn := &funcs[0]
+	if fn.Graph == nil {
+		t.Fatal("no graph for main.flags")
+	}
+
+	// the condition of the outer loop is only evaluated at the end of its
+	// body and the header of its machine loop starts with the code of the
+	// inner loop
+	bg := testBlockGraph(path, []asm{
+		{op: x86asm.MOV, line: 3, stmt: true},
+		{op: x86asm.XOR, line: 6, stmt: true},
+		{op: x86asm.JMP, line: 6, to: 4},
+		{op: x86asm.INC, line: 6, stmt: true},
+		{op: x86asm.CMP, line: 6, stmt: true},
+		{op: x86asm.JLE, line: 6, to: 10},
+		{op: x86asm.CMP, line: 7, stmt: true},
+		{op: x86asm.JGE, line: 7, to: 3},
+		{op: x86asm.MOV, line: 8, stmt: true},
+		{op: x86asm.JMP, line: 8, to: 3},
+		{op: x86asm.TEST, line: 6},
+		{op: x86asm.JNE, line: 4, stmt: true, to: 1},
+		{op: x86asm.RET, line: 12, stmt: true},
+	})
+	in := bg.StopsIn()
+	mloops := bg.Loops()
+	if len(mloops) != 2 {
+		t.Fatalf("%d machine loops, want 2", len(mloops))
+	}
+	match := matchLoops(bg, mloops, sourceLoops(fn, &s), in)
+	for _, l := range mloops {
+		want := 6
+		if l.Header.Start == 1 {
+			want = 4
+		}
+		if sl := match[l]; sl == nil || sl.start.Line != want {
+			t.Errorf("machine loop at %d matched to %v, want the loop at line %d", l.Header.Start, sl, want)
+		}
+	}
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	simpleOutput, complexOutput = devnull, devnull
+	defer func() { simpleOutput, complexOutput, counts = nil, nil, Counts{} }()
+	if penalty := checkLoops(fn, bg, in, &s); penalty != 0 {
+		t.Errorf("checkLoops penalty %d, want 0", penalty)
+	}
+}
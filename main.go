@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
 	"math"
 	"os"
@@ -13,16 +14,32 @@ import (
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage:
 	
-	badnext succ[essors] <pattern> <executable>
+	badnext [options] succ[essors] <pattern> <executable>
+	badnext [options] succ[essors] <pattern> <package>
 
 For each function matching pattern lists all acceptable successors of each line.
+If the second argument is not an executable it is interpreted as a package directory or an import path pattern (as accepted by 'go list') and functions are read directly from source.
 
-	badnext check <pattern> <executable> <tag>
+	badnext [options] check <pattern> <executable> <tag>
 	
 Checks all functions matching the pattern, prints all mismatches between successors of each line found in the executable and what badnext thinks is acceptable.
 
+	badnext [options] simulate-next <pattern> <executable> <tag>
+
+For each stop of the functions matching pattern lists the stops where a 'next' command would end, without entering calls, and reports the ones that are not acceptable successors with the path leading to them.
+
+Options:
+
+	-rules <name>	rule set used to find the successors of each line (default "default")
+	-format <fmt>	output format of succ: text, json or dot (default "text"), json and dot export the control flow graph of each function
+	-noreturn <names>	comma separated list of functions that never return, in addition to the panic functions of the runtime
+
+Available rule sets: %s
+
+Other rule sets are added by writing a file in the main package of a copy of badnext that calls RegisterRuleSet from an init function, then rebuilding it.
+
 Note: only works on amd64 executables.
-`)
+`, strings.Join(RuleSetNames(), ", "))
 	os.Exit(1)
 }
 
@@ -44,6 +61,18 @@ func digits(n uint64) int {
 	return int(math.Floor(math.Log10(float64(n)))) + 1
 }
 
+// funcGraphs returns the graphs of funcs, without the graphs of the
+// functions that were only parsed to be inlined into them.
+func funcGraphs(funcs []Function) []*Graph {
+	r := []*Graph{}
+	for i := range funcs {
+		if funcs[i].Graph != nil {
+			r = append(r, funcs[i].Graph)
+		}
+	}
+	return r
+}
+
 func printSuccessors(succs *Successors, fn *Function) {
 	const sourceColSz = 50
 	const ellipsis = "…"
@@ -85,7 +114,9 @@ func printSuccessors(succs *Successors, fn *Function) {
 		group, hasgroup := succs.G[Pos{start.File, i}]
 		nextstr := set.String()
 
-		if nextstr == "" && !hasgroup {
+		if succs.NoCode[Pos{start.File, i}] {
+			fmt.Printf("%5d %-*s // no code\n", i, sourceColSz, line)
+		} else if nextstr == "" && !hasgroup {
 			fmt.Printf("%5d %-*s\n", i, sourceColSz, line)
 		} else {
 			var groupstr string
@@ -166,41 +197,97 @@ func printf(k OutputKind, fmtstr string, args ...interface{}) {
 	}
 }
 
+func isExecutable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
 func main() {	
-	if len(os.Args) < 4 {
+	flag.Usage = usage
+	rulesName := flag.String("rules", "default", "")
+	format := flag.String("format", "text", "")
+	noreturn := flag.String("noreturn", "", "")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 3 {
 		usage()
 	}
 
-	cmd, pattern, exepath := os.Args[1], os.Args[2], os.Args[3]
-	exe := openExe(exepath)
-	funcs := exe.FunctionsMatching(pattern)
-	files := AllFiles(funcs)
-	var succs Successors
-	for _, file := range files {
-		succs.FindSuccessors(file, funcs)
+	rules, ok := LookupRuleSet(*rulesName)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown rule set %q\n", *rulesName)
+		os.Exit(1)
+	}
+
+	for _, name := range strings.Split(*noreturn, ",") {
+		if name != "" {
+			NoReturn[name] = true
+		}
+	}
+
+	cmd, pattern, exepath := args[0], args[1], args[2]
+	var exe *Executable
+	var funcs []Function
+	var files map[string][]string
+	if (cmd == "succ" || cmd == "successors") && !isExecutable(exepath) {
+		funcs, files = SourceFunctions(pattern, exepath)
+	} else {
+		exe = openExe(exepath)
+		funcs = exe.FunctionsMatching(pattern)
+		files = AllFiles(funcs)
+	}
+	// functions inlined in funcs are parsed too, their graphs are copied
+	// into the graphs of their callers
+	n := len(funcs)
+	allfuncs := append(funcs, InlinedCallees(funcs)...)
+	funcs = allfuncs[:n]
+	succs := Successors{Rules: rules}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		succs.FindSuccessors(path, files[path], allfuncs)
 	}
+	succs.SpliceInlined(allfuncs)
 
 	switch cmd {
 	case "succ", "successors":
-		for i := range funcs {
-			fn := &funcs[i]
-			printSuccessors(&succs, fn)
+		switch *format {
+		case "text":
+			for i := range funcs {
+				fn := &funcs[i]
+				printSuccessors(&succs, fn)
+			}
+		case "json":
+			must(WriteJSON(os.Stdout, funcGraphs(funcs)))
+		case "dot":
+			must(WriteDOT(os.Stdout, funcGraphs(funcs)))
+		default:
+			usage()
 		}
 	case "check":
-		if len(os.Args) < 5 {
+		if len(args) < 4 {
 			usage()
 		}
 		
-		tag := os.Args[4]
+		tag := args[3]
 		var err error
 		simpleOutput, err = os.Create(fmt.Sprintf("%s.simple.txt", tag))
 		must(err)
 		complexOutput, err = os.Create(fmt.Sprintf("%s.full.txt", tag))
 		must(err)
 		
+		if in := exe.Instrumentation(); in != 0 {
+			printf(S|C, "Instrumentation: %s\n", in)
+		}
+
 		penalty := 0
 		for i := range funcs {
 			penalty += check(&funcs[i], &succs, exe)
+			checkLineInfo(&funcs[i])
 		}
 		lineCount := 0
 		for i := range funcs {
@@ -211,10 +298,49 @@ func main() {
 			end := succs.ToPos(funcs[i].Decl.End())
 			lineCount += end.Line - start.Line
 		}
+		for cat, n := range counts {
+			if n > 0 {
+				printf(S|C, "%s: %d\n", Category(cat), n)
+			}
+		}
+		printf(S|C, "Statements with stops:\n")
+		printCoverage(coverage)
+		churn := 0
+		for _, c := range churns {
+			churn += c.Churn
+		}
+		if churn > 0 {
+			printf(S|C, "Churn: %d in %d blocks, worst blocks:\n", churn, len(churns))
+			for _, c := range worstChurn(10) {
+				printf(S|C, "\t%d %s %#x: %s\n", c.Churn, c.Fn, c.Pc, c.String())
+			}
+		}
 		if penalty > 0 {
 			printf(S|C, "Average penalty per line: %d/%d = %g\n", penalty, lineCount, float64(penalty)/float64(lineCount))
 			os.Exit(1)
 		}
+	case "simulate-next":
+		if len(args) < 4 {
+			usage()
+		}
+
+		tag := args[3]
+		var err error
+		simpleOutput, err = os.Create(fmt.Sprintf("%s.simple.txt", tag))
+		must(err)
+		complexOutput, err = os.Create(fmt.Sprintf("%s.full.txt", tag))
+		must(err)
+
+		nstops, nbad := 0, 0
+		for i := range funcs {
+			n, bad := simulateNextFunction(&funcs[i], &succs, exe)
+			nstops += n
+			nbad += bad
+		}
+		printf(S|C, "Unexpected next results: %d, stops: %d\n", nbad, nstops)
+		if nbad > 0 {
+			os.Exit(1)
+		}
 	default:
 		usage()
 	}
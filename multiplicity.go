@@ -0,0 +1,99 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"sort"
+)
+
+// expectedBreakpoints returns, for each line of x, the number of separate
+// stops a breakpoint on the line can legitimately become: one for each
+// statement starting on the line, plus one for each operand of a && or ||
+// (evaluated separately), each value of a case clause past the first
+// (compared separately), the step of range statements and the return from
+// each call inlined on the line.
+func expectedBreakpoints(x *ast.FuncDecl, fn *Function, s *Successors) map[Pos]int {
+	r := map[Pos]int{s.ToPos(x.Pos()): 1, s.ToPos(x.Body.Rbrace): 1}
+	add := func(p token.Pos, n int) {
+		r[s.ToPos(p)] += n
+	}
+	ast.Inspect(x.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BlockStmt, *ast.LabeledStmt:
+			// ok
+		case *ast.RangeStmt:
+			add(n.Pos(), 2)
+		case *ast.CaseClause:
+			if len(n.List) > 1 {
+				add(n.Pos(), len(n.List))
+			} else {
+				add(n.Pos(), 1)
+			}
+		case ast.Stmt:
+			add(n.Pos(), 1)
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				add(n.Y.Pos(), 1)
+			}
+		}
+		return true
+	})
+	for _, ic := range fn.Inlined {
+		if ic.Parent == nil {
+			r[ic.CallSite]++
+		}
+	}
+	return r
+}
+
+// checkMultiplicity counts the separate ranges of stops on each line of
+// fn, a breakpoint on the line is set on each of them, and reports the
+// lines with more than expectedBreakpoints allows: the user would hit the
+// breakpoint several times for one execution of the line.
+// Stops following an instruction of the same line, like the calls the
+// compiler marks as statements, do not start a new range. Only the code
+// of fn itself is considered, not the code inlined into it.
+func checkMultiplicity(fn *Function, bg *BlockGraph, succs *Successors) int {
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok {
+		return 0
+	}
+	expected := expectedBreakpoints(x, fn, succs)
+
+	stops := map[Pos][]uint64{}
+	lines := []Pos{}
+	for _, b := range bg.Blocks {
+		if !bg.Reachable(b) || b.Morestack {
+			continue
+		}
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			if !inst.IsStmt || inst.Inlined != nil || (inst.Helper != HelperNone && inst.Helper != HelperSpill && inst.Helper != HelperRestore) {
+				continue
+			}
+			if i > 0 && fn.Text[i-1].Pos == inst.Pos && fn.Text[i-1].Inlined == nil {
+				continue
+			}
+			if _, seen := stops[inst.Pos]; !seen {
+				lines = append(lines, inst.Pos)
+			}
+			stops[inst.Pos] = append(stops[inst.Pos], inst.Pc)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Line < lines[j].Line })
+
+	penalty := 0
+	for _, pos := range lines {
+		n, want := len(stops[pos]), expected[pos]
+		if n > 1 {
+			printf(C, "breakpoints %s:%d: %d, expected %d\n", pos.File, pos.Line, n, want)
+		}
+		if n > want && want > 0 {
+			report(CatMultiplicity, pos, stops[pos][0], "breakpoint on the line stops %d times, expected %d", n, want)
+			penalty += (n - want) * MultiplicityPenalty
+		}
+	}
+	return penalty
+}
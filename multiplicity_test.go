@@ -0,0 +1,102 @@
+package main
+
+import (
+	"debug/gosym"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const multiplicitySrc = `package main
+
+func f(s []int) int {
+	defer println("done")
+	n := 0
+	for i := 0; i < len(s) && s[i] > 0; i++ {
+		n += g(s[i])
+	}
+	for _, x := range s {
+		switch x {
+		case 1, 2:
+			n++
+		default:
+		}
+	}
+	return n
+}
+
+func g(x int) int {
+	return x * 2
+}
+`
+
+func TestMultiplicity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multiplicity.go")
+	if err := os.WriteFile(path, []byte(multiplicitySrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ic := &InlinedCall{Name: "main.g", CallSite: Pos{path, 7}}
+	funcs := []Function{{Name: "main.f", Inlined: []*InlinedCall{ic}}, {Name: "main.g"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	fn := &funcs[0]
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok {
+		t.Fatal("no declaration for main.f")
+	}
+
+	got := map[int]int{}
+	for pos, n := range expectedBreakpoints(x, fn, &s) {
+		got[pos.Line] = n
+	}
+	want := map[int]int{
+		3:  1, // declaration
+		4:  1, // defer
+		5:  1,
+		6:  4, // for, init, post and the second operand of &&
+		7:  2, // return from g
+		9:  2, // range and its step
+		10: 1,
+		11: 2, // one for each value
+		12: 1,
+		13: 1,
+		16: 1,
+		17: 1, // closing brace
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected breakpoints %v, want %v", got, want)
+	}
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	simpleOutput, complexOutput = devnull, devnull
+	defer func() { simpleOutput, complexOutput, counts = nil, nil, Counts{} }()
+
+	exe := &Executable{Gosym: &gosym.Table{}}
+	for _, tc := range []struct {
+		name  string
+		lines []int
+		bad   bool
+	}{
+		{"once", []int{5, 7}, false},
+		{"same line twice in a row", []int{5, 5, 7}, false},
+		{"declared range", []int{9, 10, 9}, false},
+		{"line split in two", []int{5, 7, 5}, true},
+		{"inlined return", []int{7, 12, 7}, false},
+		{"inlined return twice", []int{7, 12, 7, 12, 7}, true},
+	} {
+		fn.Text = make([]AsmInstruction, len(tc.lines))
+		for i, l := range tc.lines {
+			fn.Text[i] = AsmInstruction{Pc: 0x1000 + uint64(i), Pos: Pos{path, l}, IsStmt: true}
+		}
+		bg := NewBlockGraph(fn.Text, exe)
+		if got := checkMultiplicity(fn, bg, &s) != 0; got != tc.bad {
+			t.Errorf("%s: reported %v, want %v", tc.name, got, tc.bad)
+		}
+	}
+}
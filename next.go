@@ -12,13 +12,16 @@ import (
 )
 
 type Successors struct {
-	S        map[Pos]PosSet // S[a] is the set of acceptable successors of a
-	Sq map[Pos]PosSet // Sm[a] is the set of quasi-acceptable successors of a
-	G        map[Pos]uint64 // G[a] is the group identifier of a
-	fset     token.FileSet
-	curfnend Pos
-	curpos   []Pos
-	curgroup uint64 // most significant 32bits are a (toplevel) function identifier, least significant 32bits are a line-group identifier
+	S      map[Pos]PosSet        // S[a] is the set of acceptable successors of a
+	Sq     map[Pos]PosSet        // Sm[a] is the set of quasi-acceptable successors of a
+	G      map[Pos]uint64        // G[a] is the group identifier of a
+	NoCode map[Pos]bool          // lines that should not have any instructions
+	Calls  map[Pos]bool          // lines that can contain calls
+	Rules  RuleSet               // rules used to find successors, DefaultRules if nil
+	Graphs []*Graph              // control flow graphs of all functions
+	Lines  map[string][]LineKind // kind of each line of the parsed files
+	fset   token.FileSet
+	nfn    uint64 // number of functions processed so far
 }
 
 const groupMask = uint64(1<<32 - 1)
@@ -58,16 +61,29 @@ func acceptedFile(path string) bool {
 	return path != "" && strings.Index(path, "<") < 0 && strings.HasSuffix(path, ".go")
 }
 
-func (s *Successors) FindSuccessors(path string, funcs []Function) {
+// FindSuccessors parses the file at path and builds the graphs of the
+// functions of funcs it declares. The names of the functions are qualified
+// with one of pkgpaths, the import paths the functions of the file can have
+// in the executable.
+func (s *Successors) FindSuccessors(path string, pkgpaths []string, funcs []Function) {
 	if !acceptedFile(path) {
 		return
 	}
 
-	n, err := parser.ParseFile(&s.fset, path, nil, 0)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	n, err := parser.ParseFile(&s.fset, path, src, 0)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
 	}
+	if s.Lines == nil {
+		s.Lines = make(map[string][]LineKind)
+	}
+	s.Lines[path] = classifyLines(path, src)
 
 	if s.S == nil {
 		s.S = make(map[Pos]PosSet)
@@ -78,42 +94,128 @@ func (s *Successors) FindSuccessors(path string, funcs []Function) {
 	if s.Sq == nil {
 		s.Sq = make(map[Pos]PosSet)
 	}
+	if s.NoCode == nil {
+		s.NoCode = make(map[Pos]bool)
+	}
+	if s.Calls == nil {
+		s.Calls = make(map[Pos]bool)
+	}
 
-	packageName := n.Name.Name
+	rules := s.Rules
+	if rules == nil {
+		rules = DefaultRules
+	}
 
 	for _, decl := range n.Decls {
 		switch x := decl.(type) {
 		case *ast.FuncDecl:
-			name := packageName
-			if x.Recv != nil {
-				var buf bytes.Buffer
-				printer.Fprint(&buf, &s.fset, x.Recv.List[0].Type)
-				name += ".(" + buf.String() + ")"
-			}
-
-			name += "." + x.Name.Name
-
-			found := false
-			for i := range funcs {
-				if strings.HasSuffix(funcs[i].Name, name) {
-					if x.Body != nil {
-						funcs[i].Decl = x
+			var fn *Function
+			for _, pkgpath := range pkgpaths {
+				name := funcDeclName(&s.fset, pkgpath, x)
+				for i := range funcs {
+					if funcs[i].Decl == nil && sourceName(funcs[i].Name) == name {
+						fn = &funcs[i]
+						break
 					}
-					found = true
+				}
+				if fn != nil {
 					break
 				}
 			}
-			if !found || x.Body == nil {
+			if fn == nil || x.Body == nil {
 				continue
 			}
-			s.curpos = []Pos{s.ToPos(x.Pos())}
-			s.curfnend = s.ToPos(x.End())
-			s.setGroup(s.curpos[0])
-			s.findSuccBody(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
-			s.cont(false, Pos{File: "", Line: -1}) // mark end of function
-			s.curgroup = ((s.curgroup >> 32) + 1) << 32
+			fn.Decl = x
+			s.addCallLines(x)
+			b := &Builder{
+				s:        s,
+				g:        newGraph(fn.Name),
+				rules:    rules,
+				fnendPos: s.ToPos(x.End()),
+				curgroup: s.nfn << 32,
+			}
+			b.g.Entry = b.Node(NodeEntry, x, s.ToPos(x.Pos()))
+			b.Restore(Frontier{b.g.Entry})
+			b.Body(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
+			b.Cont(EdgeReturn, b.g.Exit) // mark end of function
+			b.g.addTo(s)
+			fn.Graph = b.g
+			s.Graphs = append(s.Graphs, b.g)
+			s.nfn++
+		}
+	}
+}
+
+// funcDeclName returns the name of the function declared by x, qualified
+// by qual.
+func funcDeclName(fset *token.FileSet, qual string, x *ast.FuncDecl) string {
+	name := qual
+	if x.Recv != nil {
+		typ := x.Recv.List[0].Type
+		star, ok := typ.(*ast.StarExpr)
+		if ok {
+			typ = star.X
+		}
+		generic := false
+		switch t := typ.(type) {
+		case *ast.IndexExpr:
+			typ, generic = t.X, true
+		case *ast.IndexListExpr:
+			typ, generic = t.X, true
+		}
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, typ)
+		if generic {
+			buf.WriteString("[...]")
+		}
+		// same as the names used in DWARF: pkg.(*T).M and pkg.T.M
+		if star != nil {
+			name += ".(*" + buf.String() + ")"
+		} else {
+			name += "." + buf.String()
+		}
+	}
+	name += "." + x.Name.Name
+	if x.Type.TypeParams != nil {
+		name += "[...]"
+	}
+	return name
+}
+
+// sourceName returns the name of the function called name in DWARF as
+// funcDeclName would write it: the type arguments of instantiations of
+// generic functions and types are replaced with "...".
+func sourceName(name string) string {
+	if strings.Index(name, "[") < 0 {
+		return name
+	}
+	var buf strings.Builder
+	depth := 0
+	for _, ch := range name {
+		switch {
+		case ch == '[':
+			if depth == 0 {
+				buf.WriteString("[...]")
+			}
+			depth++
+		case ch == ']':
+			depth--
+		case depth == 0:
+			buf.WriteRune(ch)
 		}
 	}
+	return buf.String()
+}
+
+// funcPackage returns the import path of the package of the function
+// called name in DWARF, "main" for the main package.
+func funcPackage(name string) string {
+	name = sourceName(name)
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot]
+	}
+	return ""
 }
 
 func (s *Successors) ToPos(pos token.Pos) Pos {
@@ -121,197 +223,399 @@ func (s *Successors) ToPos(pos token.Pos) Pos {
 	return Pos{position.Filename, position.Line}
 }
 
-func (s *Successors) cont(setPos bool, pos ...Pos) {
-	if setPos {
-		s.setGroup(pos...)
-	}
-	for i := range s.curpos {
-		s.addsucc(s.curpos[i], pos...)
-	}
-	s.curpos = pos
+// Builder holds the state used to build the Graph of a single function,
+// it is the API that rules use to describe control flow.
+type Builder struct {
+	s        *Successors
+	g        *Graph
+	rules    RuleSet
+	fnend    *Node
+	fnendPos Pos
+	cur      Frontier
+	curgroup uint64 // most significant 32bits are a (toplevel) function identifier, least significant 32bits are a line-group identifier
 }
 
-func (s *Successors) quasiAcceptableCont(pos ...Pos) {
-	for i := range s.curpos {
-		s.addqsucc(s.curpos[i], pos...)
+// Frontier is a set of nodes execution could be at.
+type Frontier []*Node
+
+// Lines returns all lines of the nodes in f.
+func (f Frontier) Lines() []Pos {
+	r := []Pos{}
+	for _, n := range f {
+		r = append(r, n.Lines...)
 	}
+	return r
 }
 
-func (s *Successors) alsoCont(setGroup bool, pos ...Pos) {
-	if setGroup {
-		s.setGroup(pos...)
+// Pos converts pos to a line.
+func (b *Builder) Pos(pos token.Pos) Pos {
+	return b.s.ToPos(pos)
+}
+
+// Graph returns the graph being built.
+func (b *Builder) Graph() *Graph {
+	return b.g
+}
+
+// FuncEnd returns the node for the closing brace of the function.
+func (b *Builder) FuncEnd() *Node {
+	if b.fnend == nil {
+		b.fnend = b.Node(NodeBrace, nil, b.fnendPos)
 	}
-	for i := range s.curpos {
-		s.addsucc(s.curpos[i], pos...)
+	return b.fnend
+}
+
+// Node creates a new node spanning lines, in the current group.
+func (b *Builder) Node(kind NodeKind, x ast.Node, lines ...Pos) *Node {
+	return b.g.newNode(kind, x, b.curgroup, lines...)
+}
+
+// AddEdge adds an edge from one node to another, without changing the
+// current nodes.
+func (b *Builder) AddEdge(from, to *Node, kind EdgeKind) {
+	b.g.addEdge(from, to, kind)
+}
+
+// Cont adds an edge of the specified kind from all current nodes to each
+// node in vn, vn becomes the new set of current nodes.
+func (b *Builder) Cont(kind EdgeKind, vn ...*Node) {
+	b.connect(kind, vn)
+	b.cur = vn
+}
+
+// AlsoCont is like Cont but vn is added to the current nodes instead of
+// replacing them.
+func (b *Builder) AlsoCont(kind EdgeKind, vn ...*Node) {
+	b.connect(kind, vn)
+	b.cur = append(b.cur, vn...)
+}
+
+// QuasiCont makes vn quasi-acceptable successors of all current nodes.
+func (b *Builder) QuasiCont(vn ...*Node) {
+	b.connect(EdgeQuasi, vn)
+}
+
+// ContAny accepts any line as the successor of the current nodes.
+func (b *Builder) ContAny() {
+	b.connect(EdgeJump, []*Node{b.g.Any})
+}
+
+func (b *Builder) connect(kind EdgeKind, vn []*Node) {
+	for _, from := range b.cur {
+		for _, to := range vn {
+			b.g.addEdge(from, to, kind)
+		}
 	}
-	s.curpos = append(s.curpos, pos...)
 }
 
-func (s *Successors) contAny() {
-	for i := range s.curpos {
-		s.S[s.curpos[i]] = PosSet{Any: true}
+// Save returns a copy of the current nodes.
+func (b *Builder) Save() Frontier {
+	r := make(Frontier, len(b.cur))
+	copy(r, b.cur)
+	return r
+}
+
+// Restore replaces the current nodes with the union of fs.
+func (b *Builder) Restore(fs ...Frontier) {
+	b.cur = Frontier{}
+	for _, f := range fs {
+		b.cur = append(b.cur, f...)
 	}
 }
 
-func (s *Successors) findSuccBody(lbrace, rbrace token.Pos, list []ast.Stmt) {
-	s.curgroup++
-	s.alsoCont(true, s.ToPos(lbrace))
+// Group returns the current group.
+func (b *Builder) Group() uint64 {
+	return b.curgroup
+}
+
+// NextGroup starts a new group.
+func (b *Builder) NextGroup() {
+	b.curgroup++
+}
+
+// Body walks a list of statements delimited by lbrace and rbrace and
+// returns the nodes of its braces.
+func (b *Builder) Body(lbrace, rbrace token.Pos, list []ast.Stmt) (open, close *Node) {
+	b.NextGroup()
+	open = b.Node(NodeBrace, nil, b.Pos(lbrace))
+	b.AlsoCont(EdgeNext, open)
 
 	for _, stmt := range list {
-		s.findSuccStmt(stmt)
+		b.Stmt(stmt)
+	}
+
+	if b.Pos(rbrace) == b.fnendPos {
+		close = b.FuncEnd()
+	} else {
+		close = b.Node(NodeBrace, nil, b.Pos(rbrace))
 	}
+	b.AlsoCont(EdgeNext, close)
+	b.NextGroup()
+	return open, close
+}
 
-	s.alsoCont(true, s.ToPos(rbrace))
-	s.curgroup++
+// Stmt walks stmt using the first rule that applies to it.
+func (b *Builder) Stmt(stmt ast.Stmt) {
+	cur := b.Save()
+	for _, rule := range b.rules {
+		if rule.Apply(stmt, cur, b) {
+			return
+		}
+	}
+	pos := b.Pos(stmt.Pos())
+	fmt.Fprintf(os.Stderr, "%s:%d: unknown statement type %T\n", pos.File, pos.Line, stmt)
 }
 
-func (s *Successors) findSuccStmt(stmt ast.Stmt) {
-	switch stmt.(type) {
-	case *ast.DeclStmt:
-		decl := stmt.(*ast.DeclStmt).Decl.(*ast.GenDecl)
-		if decl.Tok == token.VAR {
-			for _, spec := range decl.Specs {
-				spec := spec.(*ast.ValueSpec)
-				s.cont(true, s.allPositions(spec)...)
+// Positions returns all lines spanned by x.
+func (b *Builder) Positions(x ast.Node) []Pos {
+	if x == nil {
+		return nil
+	}
+	if !x.Pos().IsValid() || !x.End().IsValid() {
+		return nil
+	}
+	r := []Pos{}
+	var last Pos
+	for p := x.Pos(); p < x.End(); p++ {
+		cur := b.Pos(p)
+		if cur != last {
+			if last.File != "" && cur.File != last.File {
+				return nil
 			}
+			r = append(r, cur)
+			last = cur
+		}
+	}
+	return r
+}
+
+// Expr creates a new node for the lines spanned by x, it returns nil if x
+// is nil or does not span any line.
+func (b *Builder) Expr(kind NodeKind, x ast.Node) *Node {
+	if x == nil {
+		return nil
+	}
+	lines := b.Positions(x)
+	if len(lines) == 0 {
+		return nil
+	}
+	return b.Node(kind, x, lines...)
+}
+
+func declRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.DeclStmt)
+	if !ok {
+		return false
+	}
+	decl := x.Decl.(*ast.GenDecl)
+	if decl.Tok == token.VAR {
+		for _, spec := range decl.Specs {
+			head, entry, exit := b.Simple(NodeStmt, spec)
+			head.AnyOrder = true
+			b.Cont(EdgeNext, entry...)
+			b.Restore(exit)
 		}
+	}
+	return true
+}
+
+func goSendRule(n ast.Node, cur Frontier, b *Builder) bool {
+	switch n.(type) {
 	case *ast.GoStmt, *ast.SendStmt:
-		s.cont(true, s.ToPos(stmt.Pos()), s.ToPos(stmt.End()))
-	case *ast.DeferStmt:
-		s.cont(true, s.ToPos(stmt.Pos()), s.ToPos(stmt.End()))
-		s.alsoCont(false, Pos{ File: "", Line: -1 })
-	case *ast.EmptyStmt:
-		// Nothing to do
+		b.Cont(EdgeNext, b.Node(NodeStmt, n, b.Pos(n.Pos()), b.Pos(n.End())))
+		return true
+	}
+	return false
+}
+
+func deferRule(n ast.Node, cur Frontier, b *Builder) bool {
+	if _, ok := n.(*ast.DeferStmt); !ok {
+		return false
+	}
+	defernode := b.Node(NodeStmt, n, b.Pos(n.Pos()), b.Pos(n.End()))
+	b.Cont(EdgeNext, defernode)
+	b.AddEdge(defernode, b.Graph().Exit, EdgeDefer)
+	return true
+}
+
+func emptyRule(n ast.Node, cur Frontier, b *Builder) bool {
+	_, ok := n.(*ast.EmptyStmt)
+	return ok
+}
+
+func exprRule(n ast.Node, cur Frontier, b *Builder) bool {
+	switch n.(type) {
 	case *ast.ExprStmt, *ast.AssignStmt, *ast.IncDecStmt:
-		s.findSuccExpr(stmt)
-	case *ast.ForStmt:
-		s.findSuccFor(stmt.(*ast.ForStmt))
-	case *ast.RangeStmt:
-		s.findSuccRange(stmt.(*ast.RangeStmt))
-	case *ast.IfStmt:
-		s.findSuccIf(stmt.(*ast.IfStmt))
-	case *ast.LabeledStmt:
-		x := stmt.(*ast.LabeledStmt)
-		s.alsoCont(true, s.ToPos(x.Colon))
-		s.findSuccStmt(x.Stmt)
-	case *ast.SelectStmt:
-		x := stmt.(*ast.SelectStmt)
-		s.findSuccSwitch(x.Select, nil, nil, nil, x.Body)
-	case *ast.SwitchStmt:
-		x := stmt.(*ast.SwitchStmt)
-		s.findSuccSwitch(x.Switch, x.Init, x.Tag, nil, x.Body)
-	case *ast.TypeSwitchStmt:
-		x := stmt.(*ast.TypeSwitchStmt)
-		s.findSuccSwitch(x.Switch, x.Init, nil, x.Assign, x.Body)
-	case *ast.BranchStmt:
-		s.cont(true, s.allPositions(stmt)...)
-		s.contAny()
-	case *ast.ReturnStmt:
-		s.findSuccReturn(stmt)
 	default:
-		pos := s.ToPos(stmt.Pos())
-		fmt.Fprintf(os.Stderr, "%s:%d: unknown statement type %T\n", pos.File, pos.Line, stmt)
+		return false
 	}
+	head, entry, exit := b.Simple(NodeStmt, n)
+	head.AnyOrder = true
+	b.Cont(EdgeNext, entry...)
+	b.Restore(exit)
+	return true
 }
 
-func (s *Successors) findSuccExpr(x ast.Stmt) {
-	positions := s.allPositions(x)
-	for _, pos := range positions {
-		s.addsucc(pos, positions...)
+func returnRule(n ast.Node, cur Frontier, b *Builder) bool {
+	if _, ok := n.(*ast.ReturnStmt); !ok {
+		return false
+	}
+	ret, entry, retexit := b.Simple(NodeStmt, n)
+	ret.AnyOrder = true
+	fnend := b.FuncEnd()
+	exit := b.Graph().Exit
+	b.Cont(EdgeNext, append(entry, fnend)...)
+	for _, prev := range cur {
+		b.AddEdge(prev, exit, EdgeReturn)
 	}
-	s.cont(true, positions...)
+	for _, n := range retexit {
+		b.AddEdge(n, fnend, EdgeReturn)
+		b.AddEdge(n, exit, EdgeReturn)
+	}
+	b.AddEdge(fnend, ret, EdgeReturn)
+	b.AddEdge(fnend, exit, EdgeReturn)
+	b.Restore(retexit, Frontier{fnend})
+	return true
 }
 
-func (s *Successors) findSuccReturn(x ast.Stmt) {
-	positions := s.allPositions(x)
-	positions = append(positions, s.curfnend, Pos{ "", -1 })
-	s.addsucc(s.curfnend, positions...)
-	for _, pos := range positions {
-		s.addsucc(pos, positions...)
+func branchRule(n ast.Node, cur Frontier, b *Builder) bool {
+	if _, ok := n.(*ast.BranchStmt); !ok {
+		return false
 	}
-	s.cont(true, positions...)
+	b.Cont(EdgeNext, b.Node(NodeStmt, n, b.Positions(n)...))
+	b.ContAny()
+	return true
 }
 
-func (s *Successors) findSuccFor(x *ast.ForStmt) {
-	s.curgroup++
-	condPositions := s.allPositions(x.Cond)
-	condPositions = append(condPositions, s.ToPos(x.For))
+func labeledRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.LabeledStmt)
+	if !ok {
+		return false
+	}
+	b.AlsoCont(EdgeNext, b.Node(NodeLabel, x, b.Pos(x.Colon)))
+	b.Stmt(x.Stmt)
+	return true
+}
+
+func forRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.ForStmt)
+	if !ok {
+		return false
+	}
+	b.NextGroup()
+	cond := b.Node(NodeExpr, x, append(b.Positions(x.Cond), b.Pos(x.For))...)
 
-	if initPositions := s.allPositions(x.Init); len(initPositions) > 0 {
-		s.cont(true, initPositions...)
+	if init := b.Expr(NodeStmt, x.Init); init != nil {
+		b.Cont(EdgeNext, init)
 	}
-	s.cont(true, condPositions...)
-	s.setGroup(s.allPositions(x.Post)...)
-	s.findSuccBody(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
-	if postPositions := s.allPositions(x.Post); len(postPositions) > 0 {
-		s.cont(false, postPositions...)
+	b.Cont(EdgeNext, cond)
+	post := b.Expr(NodeStmt, x.Post)
+	_, close := b.Body(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
+	if post != nil {
+		b.Cont(EdgeNext, post)
 	}
-	s.alsoCont(false, condPositions...)
-	s.alsoCont(false, s.ToPos(x.Body.Rbrace))
-	s.curgroup++
+	b.AlsoCont(EdgeLoop, cond)
+	b.AlsoCont(EdgeNext, close)
+	b.NextGroup()
+	return true
 }
 
-func (s *Successors) findSuccRange(x *ast.RangeStmt) {
-	s.curgroup++
-	s.setGroup(s.allPositions(x.X)...)
-	s.cont(true, s.allPositions(x.X)...)
-	s.findSuccBody(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
-	s.alsoCont(false, s.ToPos(x.For))
+func rangeRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.RangeStmt)
+	if !ok {
+		return false
+	}
+	b.NextGroup()
+	header := b.Node(NodeExpr, x, b.Positions(x.X)...)
+	b.Cont(EdgeNext, header)
+	b.Body(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
+	b.AlsoCont(EdgeLoop, header)
+	return true
 }
 
-func (s *Successors) findSuccIf(ifstmt ast.Stmt) {
-	s.curgroup++
-	
-	headerPositions := []Pos{}
-	
-	var lastIfCond []Pos
-	
-	var curposBlockends []Pos
-	for ifstmt != nil {
+func ifRule(n ast.Node, cur Frontier, b *Builder) bool {
+	if _, ok := n.(*ast.IfStmt); !ok {
+		return false
+	}
+	b.NextGroup()
+
+	var headers Frontier
+
+	var lastIfCond *Node
+
+	var blockends Frontier
+	for ifstmt := n; ifstmt != nil; {
 		switch x := ifstmt.(type) {
 		case *ast.IfStmt:
-			condPositions := s.allPositions(x.Cond)
-			lastIfCond = condPositions
-			
-			headerPositions = append(headerPositions, condPositions...)
-
-			if initPositions := s.allPositions(x.Init); len(initPositions) > 0 {
-				s.cont(true, initPositions...)
+			if init := b.Expr(NodeStmt, x.Init); init != nil {
+				b.Cont(EdgeNext, init)
 			}
-			s.cont(true, condPositions...)
-			curposLastcond := s.curposSave()
-			s.findSuccBody(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
-			curposBlockends = append(curposBlockends, s.curpos...)
-			s.quasiAcceptableCont(curposLastcond...)
-			s.curpos = curposLastcond
+			cond := b.Node(NodeExpr, x.Cond, b.Positions(x.Cond)...)
+			lastIfCond = cond
+			headers = append(headers, cond)
+
+			b.Cont(EdgeNext, cond)
+			b.Body(x.Body.Lbrace, x.Body.Rbrace, x.Body.List)
+			blockends = append(blockends, b.Save()...)
+			b.QuasiCont(cond)
+			b.Restore(Frontier{cond})
 			ifstmt = x.Else
 
 		case *ast.BlockStmt:
-			s.findSuccBody(x.Lbrace, x.Rbrace, x.List)
-			curposBlockends = append(curposBlockends, s.curpos...)
-			s.quasiAcceptableCont(lastIfCond...)
-			s.curpos = []Pos{}
+			b.Body(x.Lbrace, x.Rbrace, x.List)
+			blockends = append(blockends, b.Save()...)
+			b.QuasiCont(lastIfCond)
+			b.Restore()
 			ifstmt = nil
 		}
 	}
-		
-	s.curpos = append(s.curpos, curposBlockends...)
-	s.curpos = append(s.curpos, headerPositions...)
+
+	b.Restore(b.Save(), blockends, headers)
+	return true
+}
+
+func selectRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.SelectStmt)
+	if !ok {
+		return false
+	}
+	switchBody(b, x, x.Select, nil, nil, nil, x.Body)
+	return true
+}
+
+func switchRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.SwitchStmt)
+	if !ok {
+		return false
+	}
+	switchBody(b, x, x.Switch, x.Init, x.Tag, nil, x.Body)
+	return true
+}
+
+func typeSwitchRule(n ast.Node, cur Frontier, b *Builder) bool {
+	x, ok := n.(*ast.TypeSwitchStmt)
+	if !ok {
+		return false
+	}
+	switchBody(b, x, x.Switch, x.Init, nil, x.Assign, x.Body)
+	return true
 }
 
-func (s *Successors) findSuccSwitch(key token.Pos, init ast.Stmt, tag ast.Expr, assign ast.Stmt, body *ast.BlockStmt) {
-	s.curgroup++
-	if initPositions := s.allPositions(init); len(initPositions) > 0 {
-		s.cont(true, initPositions...)
+func switchBody(b *Builder, stmt ast.Stmt, key token.Pos, init ast.Stmt, tag ast.Expr, assign ast.Stmt, body *ast.BlockStmt) {
+	b.NextGroup()
+	if initNode := b.Expr(NodeStmt, init); initNode != nil {
+		b.Cont(EdgeNext, initNode)
 	}
-	tagPositions := s.allPositions(tag)
-	tagPositions = append(tagPositions, s.ToPos(key))
-	s.cont(true, tagPositions...)
+	header := b.Node(NodeExpr, stmt, append(b.Positions(tag), b.Pos(key))...)
+	b.Cont(EdgeNext, header)
 
-	groupHeader := s.curgroup
-	curposHeader := s.curposSave()
-	clausePositions := []Pos{}
-	curposBlockends := []Pos{}
+	groupHeader := b.Group()
+	var assignNode *Node
+	if assign != nil {
+		assignNode = b.Node(NodeStmt, assign, b.Positions(assign)...)
+	}
+	var clauses Frontier
+	var blockends Frontier
 
 	for _, stmt := range body.List {
 		var clauseHeader []ast.Node
@@ -325,76 +629,42 @@ func (s *Successors) findSuccSwitch(key token.Pos, init ast.Stmt, tag ast.Expr,
 			clauseHeader = []ast.Node{stmt.Comm}
 		}
 
-		s.curpos = []Pos{}
+		var lines []Pos
 		for _, x := range clauseHeader {
-			vpos := s.allPositions(x)
-			s.setGroup(vpos...)
-			s.curpos = append(s.curpos, vpos...)
+			lines = append(lines, b.Positions(x)...)
 		}
-		clausePos := s.ToPos(stmt.Pos())
-		s.setGroup(clausePos)
-		s.curpos = append(s.curpos, clausePos)
-
-		clausePositions = append(clausePositions, s.curpos...)
-
-		if assign != nil {
-			s.cont(false, s.allPositions(assign)...)
+		lines = append(lines, b.Pos(stmt.Pos()))
+		clause := b.Node(NodeClause, stmt, lines...)
+		clause.Group = groupHeader
+		clauses = append(clauses, clause)
+		b.Restore(Frontier{clause})
+
+		if assignNode != nil {
+			b.Cont(EdgeNext, assignNode)
 		}
 
 		switch stmt := stmt.(type) {
 		case *ast.CaseClause:
-			s.findSuccBody(stmt.Colon, body.Rbrace, stmt.Body)
+			b.Body(stmt.Colon, body.Rbrace, stmt.Body)
 		case *ast.CommClause:
-			s.findSuccBody(stmt.Colon, body.Rbrace, stmt.Body)
+			b.Body(stmt.Colon, body.Rbrace, stmt.Body)
 		}
-		curposBlockends = append(curposBlockends, s.curpos...)
-		s.quasiAcceptableCont(tagPositions...)
-	}
-
-	for _, pos := range clausePositions {
-		s.G[pos] = groupHeader
-		s.addsucc(pos, clausePositions...)
-		s.addqsucc(pos, tagPositions...)
+		blockends = append(blockends, b.Save()...)
+		b.QuasiCont(header)
 	}
 
-	s.curpos = curposHeader
-	s.alsoCont(false, clausePositions...)
-	s.alsoCont(false, s.ToPos(body.Rbrace))
-	s.curpos = append(s.curpos, curposBlockends...)
-}
-
-func (s *Successors) curposSave() []Pos {
-	r := make([]Pos, len(s.curpos))
-	copy(r, s.curpos)
-	return r
-}
-
-func (s *Successors) allPositions(x ast.Node) []Pos {
-	if x == nil {
-		return nil
-	}
-	if !x.Pos().IsValid() || !x.End().IsValid() {
-		return nil
-	}
-	r := []Pos{}
-	var last Pos
-	for p := x.Pos(); p < x.End(); p++ {
-		cur := s.ToPos(p)
-		if cur != last {
-			if last.File != "" && cur.File != last.File {
-				return nil
+	for _, clause := range clauses {
+		clause.AnyOrder = true
+		for _, other := range clauses {
+			if other != clause {
+				b.AddEdge(clause, other, EdgeNext)
 			}
-			r = append(r, cur)
-			last = cur
 		}
+		b.AddEdge(clause, header, EdgeQuasi)
 	}
-	return r
-}
 
-func (s *Successors) setGroup(vpos ...Pos) {
-	for _, pos := range vpos {
-		if _, hasgroup := s.G[pos]; !hasgroup {
-			s.G[pos] = s.curgroup
-		}
-	}
+	b.Restore(Frontier{header})
+	b.AlsoCont(EdgeNext, clauses...)
+	b.AlsoCont(EdgeNext, b.Node(NodeBrace, nil, b.Pos(body.Rbrace)))
+	b.Restore(b.Save(), blockends)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestFuncPackage(t *testing.T) {
+	for _, tc := range []struct {
+		name, sourceName, pkgpath string
+	}{
+		{"main.main", "main.main", "main"},
+		{"main.(*T).M", "main.(*T).M", "main"},
+		{"main.f.func1", "main.f.func1", "main"},
+		{"example.com/rv/v2.Twice", "example.com/rv/v2.Twice", "example.com/rv/v2"},
+		{"example.com/rv/util-x.Sum", "example.com/rv/util-x.Sum", "example.com/rv/util-x"},
+		{"example.com/rv/util-x.Max[go.shape.int]", "example.com/rv/util-x.Max[...]", "example.com/rv/util-x"},
+		{"example.com/rv/util-x.(*Box[go.shape.int]).Get", "example.com/rv/util-x.(*Box[...]).Get", "example.com/rv/util-x"},
+		{"slices.stableCmpFunc[go.shape.struct { Key reflect.Value; Value reflect.Value }]", "slices.stableCmpFunc[...]", "slices"},
+		{"internal/sync.(*HashTrieMap[go.shape.interface {},go.shape.[]int]).Load", "internal/sync.(*HashTrieMap[...]).Load", "internal/sync"},
+	} {
+		if got := sourceName(tc.name); got != tc.sourceName {
+			t.Errorf("sourceName(%q) = %q, want %q", tc.name, got, tc.sourceName)
+		}
+		if got := funcPackage(tc.name); got != tc.pkgpath {
+			t.Errorf("funcPackage(%q) = %q, want %q", tc.name, got, tc.pkgpath)
+		}
+	}
+}
+
+func TestFuncDeclName(t *testing.T) {
+	const src = `package util
+
+func F() {}
+func (b Box) M() {}
+func (b *Box) P() {}
+func (b *Box[T]) Get() T {}
+func (m Map[K, V]) Len() int {}
+func Max[T int | float64](a, b T) T {}
+`
+	var fset token.FileSet
+	n, err := parser.ParseFile(&fset, "u.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"example.com/rv/util-x.F",
+		"example.com/rv/util-x.Box.M",
+		"example.com/rv/util-x.(*Box).P",
+		"example.com/rv/util-x.(*Box[...]).Get",
+		"example.com/rv/util-x.Map[...].Len",
+		"example.com/rv/util-x.Max[...]",
+	}
+	for i, decl := range n.Decls {
+		if got := funcDeclName(&fset, "example.com/rv/util-x", decl.(*ast.FuncDecl)); got != want[i] {
+			t.Errorf("funcDeclName(%d) = %q, want %q", i, got, want[i])
+		}
+	}
+}
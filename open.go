@@ -8,6 +8,7 @@ import (
 	"debug/gosym"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type Section interface {
@@ -19,9 +20,46 @@ type Executable struct {
 	TextStart uint64
 	Text      []byte
 	Gosym *gosym.Table
+
+	sections        []*mappedSection
+	abstractOrigins map[dwarf.Offset]string
+	functions       map[uint64]*Function      // cache of FunctionAt
+	subprograms     map[uint64][2]dwarf.Offset // compile unit and entry of each function, by entry point
+	symbols         map[string]uint64          // address of each symbol of the symbol table
+	instrumentation map[dwarf.Offset]Instrumentation // cache of instrumentationAt, by compile unit
+}
+
+// mappedSection is a section that is loaded in memory when the executable
+// runs.
+type mappedSection struct {
+	Addr, Size uint64
+	Section
+	data []byte
 }
 
-type openFn func(string) (dwarfData *dwarf.Data, textStart uint64, text Section, goSymboltable *gosym.Table)
+type openFn func(string) (dwarfData *dwarf.Data, textStart uint64, text Section, goSymboltable *gosym.Table, sections []*mappedSection, symbols map[string]uint64)
+
+// ReadMemory returns the size bytes of the executable mapped at addr.
+func (exe *Executable) ReadMemory(addr uint64, size int) ([]byte, error) {
+	for _, sect := range exe.sections {
+		if addr < sect.Addr || addr+uint64(size) > sect.Addr+sect.Size {
+			continue
+		}
+		if sect.data == nil {
+			data, err := sect.Data()
+			if err != nil {
+				return nil, err
+			}
+			sect.data = data
+		}
+		off := addr - sect.Addr
+		if off+uint64(size) > uint64(len(sect.data)) {
+			break
+		}
+		return sect.data[off : off+uint64(size)], nil
+	}
+	return nil, fmt.Errorf("could not read %d bytes at %#x", size, addr)
+}
 
 // Borrowed from https://golang.org/src/cmd/internal/objfile/pe.go
 func pclnPE(exe *pe.File) (textStart uint64, symtab, pclntab []byte, err error) {
@@ -93,10 +131,10 @@ func findPESymbol(f *pe.File, name string) (*pe.Symbol, error) {
 	return nil, fmt.Errorf("no %s symbol found", name)
 }
 
-func openPE(path string) (*dwarf.Data, uint64, Section, *gosym.Table) {
+func openPE(path string) (*dwarf.Data, uint64, Section, *gosym.Table, []*mappedSection, map[string]uint64) {
 	file, _ := pe.Open(path)
 	if file == nil {
-		return nil, 0, nil, nil
+		return nil, 0, nil, nil, nil, nil
 	}
 	dwarf, err := file.DWARF()
 	must(err)
@@ -106,13 +144,23 @@ func openPE(path string) (*dwarf.Data, uint64, Section, *gosym.Table) {
 	pcln := gosym.NewLineTable(pclndat, uint64(file.Section(".text").Offset))
 	tab, err := gosym.NewTable(symdat, pcln)
 	must(err)
-	return dwarf, textStart, textsect, tab
+	sections := []*mappedSection{}
+	for _, sect := range file.Sections {
+		sections = append(sections, &mappedSection{Addr: textStart - uint64(textsect.VirtualAddress) + uint64(sect.VirtualAddress), Size: uint64(sect.VirtualSize), Section: sect})
+	}
+	symbols := map[string]uint64{}
+	for _, sym := range file.Symbols {
+		if sym.SectionNumber > 0 && int(sym.SectionNumber) <= len(file.Sections) {
+			symbols[sym.Name] = textStart - uint64(textsect.VirtualAddress) + uint64(file.Sections[sym.SectionNumber-1].VirtualAddress) + uint64(sym.Value)
+		}
+	}
+	return dwarf, textStart, textsect, tab, sections, symbols
 }
 
-func openMacho(path string) (*dwarf.Data, uint64, Section, *gosym.Table) {
+func openMacho(path string) (*dwarf.Data, uint64, Section, *gosym.Table, []*mappedSection, map[string]uint64) {
 	file, _ := macho.Open(path)
 	if file == nil {
-		return nil, 0, nil, nil
+		return nil, 0, nil, nil, nil, nil
 	}
 	dwarf, err := file.DWARF()
 	must(err)
@@ -136,14 +184,29 @@ func openMacho(path string) (*dwarf.Data, uint64, Section, *gosym.Table) {
 	pcln := gosym.NewLineTable(pclndat, textsect.Addr)
 	tab, err := gosym.NewTable(symdat, pcln)
 	must(err)
+
+	sections := []*mappedSection{}
+	for _, sect := range file.Sections {
+		if sect.Addr != 0 && sect.Offset != 0 {
+			sections = append(sections, &mappedSection{Addr: sect.Addr, Size: sect.Size, Section: sect})
+		}
+	}
+
+	symbols := map[string]uint64{}
+	if file.Symtab != nil {
+		for _, sym := range file.Symtab.Syms {
+			// Mach-O symbol names have a leading underscore
+			symbols[strings.TrimPrefix(sym.Name, "_")] = sym.Value
+		}
+	}
 	
-	return dwarf, textsect.Addr, textsect, tab
+	return dwarf, textsect.Addr, textsect, tab, sections, symbols
 }
 
-func openElf(path string) (*dwarf.Data, uint64, Section, *gosym.Table) {
+func openElf(path string) (*dwarf.Data, uint64, Section, *gosym.Table, []*mappedSection, map[string]uint64) {
 	file, _ := elf.Open(path)
 	if file == nil {
-		return nil, 0, nil, nil
+		return nil, 0, nil, nil, nil, nil
 	}
 	dwarf, err := file.DWARF()
 	must(err)
@@ -167,13 +230,26 @@ func openElf(path string) (*dwarf.Data, uint64, Section, *gosym.Table) {
 	pcln := gosym.NewLineTable(pclndat, textsect.Addr)
 	tab, err := gosym.NewTable(symdat, pcln)
 	must(err)
+
+	sections := []*mappedSection{}
+	for _, sect := range file.Sections {
+		if sect.Flags&elf.SHF_ALLOC != 0 && sect.Type != elf.SHT_NOBITS {
+			sections = append(sections, &mappedSection{Addr: sect.Addr, Size: sect.Size, Section: sect})
+		}
+	}
+
+	symbols := map[string]uint64{}
+	syms, _ := file.Symbols()
+	for _, sym := range syms {
+		symbols[sym.Name] = sym.Value
+	}
 	
-	return dwarf, textsect.Addr, textsect, tab
+	return dwarf, textsect.Addr, textsect, tab, sections, symbols
 }
 
 func openExe(exepath string) *Executable {
 	for _, fn := range []openFn{openPE, openElf, openMacho} {
-		dd, textStart, textSect, goSymbolTable := fn(exepath)
+		dd, textStart, textSect, goSymbolTable, sections, symbols := fn(exepath)
 		if dd != nil {
 			textData, err := textSect.Data()
 			must(err)
@@ -182,6 +258,9 @@ func openExe(exepath string) *Executable {
 				TextStart: textStart,
 				Text:      textData,
 				Gosym: goSymbolTable,
+
+				sections: sections,
+				symbols:  symbols,
 			}
 		}
 	}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	maxPathVisits = 50000 // blocks visited by checkPaths in a single function
+)
+
+// pathStop is a stop on a path through the machine code, attributed to
+// the function itself: stops in inlined calls are attributed to the line
+// of the outermost call.
+type pathStop struct {
+	Pos Pos
+	Pc  uint64
+}
+
+// sourceState is the set of nodes of the source graph execution can be
+// at, in increasing order of ID, or any node.
+type sourceState struct {
+	nodes []*Node
+	any   bool
+}
+
+func (st sourceState) key() string {
+	if st.any {
+		return "any"
+	}
+	v := make([]string, len(st.nodes))
+	for i, n := range st.nodes {
+		v[i] = fmt.Sprint(n.ID)
+	}
+	return strings.Join(v, ",")
+}
+
+// pathChecker follows the stops of paths through the machine code of a
+// function on its source graph.
+type pathChecker struct {
+	g          *Graph
+	start, end Pos               // declaration of the function
+	stopped    map[Pos]bool      // lines with at least one stop
+	optional   map[ast.Node]bool // statements the code can skip
+}
+
+// own returns true if n belongs to the function itself, not to a call
+// inlined into it, and the machine code can stop at it. Nodes of lines
+// without stops, like a default clause, are crossed by the paths of the
+// machine code.
+func (pc *pathChecker) own(n *Node) bool {
+	if n == pc.g.Exit {
+		return true
+	}
+	if n.Kind == NodeInline || len(n.Lines) == 0 {
+		return false
+	}
+	if !pc.inFunction(n.Lines[0]) {
+		return false
+	}
+	for _, pos := range n.Lines {
+		if pc.stopped[pos] {
+			return true
+		}
+	}
+	return false
+}
+
+// inFunction returns true if pos is a line of the declaration of the
+// function.
+func (pc *pathChecker) inFunction(pos Pos) bool {
+	return pos.File == pc.start.File && pos.Line >= pc.start.Line && pos.Line <= pc.end.Line
+}
+
+// containing returns the state made of all the nodes containing pos.
+func (pc *pathChecker) containing(pos Pos) sourceState {
+	st := sourceState{}
+	for _, n := range pc.g.Nodes {
+		if pc.own(n) && containsPos(n.Lines, pos) {
+			st.nodes = append(st.nodes, n)
+		}
+	}
+	return st
+}
+
+// step returns the nodes containing pos that execution can be at after
+// st: one of the nodes of st, or one of their successors. Nodes of
+// inlined calls are crossed, they are attributed to the line of the call,
+// and so are the successors of nodes containing pos, since moving between
+// them does not stop at a new line. The assignment of a type switch, which
+// the source graph repeats at the start of each clause, can be crossed too:
+// the code may evaluate it only once, before choosing the clause.
+// Quasi-acceptable edges are not followed, like the acceptable successors
+// of a line.
+func (pc *pathChecker) step(st sourceState, pos Pos) sourceState {
+	if st.any {
+		return pc.containing(pos)
+	}
+	seen, crossed := map[*Node]bool{}, map[*Node]bool{}
+	r := sourceState{}
+	queue := append([]*Node{}, st.nodes...)
+	add := func(n *Node) {
+		if !seen[n] && containsPos(n.Lines, pos) {
+			r.nodes = append(r.nodes, n)
+			queue = append(queue, n)
+		}
+		seen[n] = true
+	}
+	for _, n := range st.nodes {
+		add(n)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, e := range n.Out {
+			switch {
+			case e.Kind == EdgeQuasi:
+			case e.To == pc.g.Any:
+				r.any = true
+			case pc.own(e.To):
+				add(e.To)
+				if pc.optional[e.To.AST] && !crossed[e.To] {
+					crossed[e.To] = true
+					queue = append(queue, e.To)
+				}
+			case !seen[e.To]:
+				seen[e.To] = true
+				queue = append(queue, e.To)
+			}
+		}
+	}
+	if r.any {
+		return pc.containing(pos)
+	}
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i].ID < r.nodes[j].ID })
+	return r
+}
+
+// feasible returns true if the lines of seq can be visited in order,
+// starting from st.
+func (pc *pathChecker) feasible(st sourceState, seq []pathStop) bool {
+	for _, stop := range seq {
+		st = pc.step(st, stop.Pos)
+		if len(st.nodes) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pathStops returns the stops of b.
+func (bg *BlockGraph) pathStops(b *Block) []pathStop {
+	r := []pathStop{}
+	for i := b.Start; i < b.End; i++ {
+		inst := bg.Text[i]
+		if !inst.IsStmt || (inst.Helper != HelperNone && inst.Helper != HelperSpill && inst.Helper != HelperRestore) {
+			continue
+		}
+		pos := inst.Pos
+		for ic := inst.Inlined; ic != nil; ic = ic.Parent {
+			pos = ic.CallSite
+		}
+		r = append(r, pathStop{pos, inst.Pc})
+	}
+	return r
+}
+
+// pathProblem is a sequence of lines that no path of the source graph
+// visits, found on a path through the machine code.
+type pathProblem struct {
+	Lines  []pathStop // shortest infeasible suffix of the lines of the path
+	Blocks []uint64   // first address of each block of the path
+	Seq    []pathStop // lines of the path
+}
+
+// checkPaths enumerates the acyclic paths through the machine code of fn,
+// from its entry to its returns, and follows the lines of their stops on
+// the source graph of fn. Lines that no path of the source graph can reach
+// from the lines before them are reported, unless the transition from the
+// previous line is already reported by check, with the shortest path
+// found for each pair of lines. These are sequences where each transition
+// is acceptable on its own, for example the body of an else branch
+// followed by the body of its if, or a line visited twice without a loop
+// between the visits.
+// Paths reaching the same block with the same state on the source graph
+// are only followed once, and at most maxPathVisits blocks are visited.
+func checkPaths(fn *Function, bg *BlockGraph, succs *Successors) int {
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok || fn.Graph == nil || len(bg.Blocks) == 0 {
+		return 0
+	}
+	pc := &pathChecker{g: fn.Graph, start: succs.ToPos(x.Pos()), end: succs.ToPos(x.End()), stopped: map[Pos]bool{}, optional: map[ast.Node]bool{}}
+	ast.Inspect(x, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSwitchStmt); ok {
+			pc.optional[ts.Assign] = true
+		}
+		return true
+	})
+
+	stops := make([][]pathStop, len(bg.Blocks))
+	for _, b := range bg.Blocks {
+		stops[b.ID] = bg.pathStops(b)
+		for _, stop := range stops[b.ID] {
+			pc.stopped[stop.Pos] = true
+		}
+	}
+
+	problems := map[[2]Pos]*pathProblem{}
+	keys := [][2]Pos{}
+	done := map[string]bool{}
+	onPath := make([]bool, len(bg.Blocks))
+	path := []*Block{}
+	seq := []pathStop{}
+	visits := 0
+
+	found := func(k int) {
+		key := [2]Pos{seq[k-1].Pos, seq[k].Pos}
+		if p := problems[key]; p != nil && len(p.Blocks) <= len(path) {
+			return
+		}
+		j := k - 1
+		for j > 0 && pc.feasible(pc.containing(seq[j].Pos), seq[j+1:k+1]) {
+			j--
+		}
+		p := &pathProblem{Lines: append([]pathStop{}, seq[j:k+1]...), Seq: append([]pathStop{}, seq[:k+1]...)}
+		for _, b := range path {
+			p.Blocks = append(p.Blocks, bg.Text[b.Start].Pc)
+		}
+		if problems[key] == nil {
+			keys = append(keys, key)
+		}
+		problems[key] = p
+	}
+
+	var visit func(b *Block, st sourceState)
+	visit = func(b *Block, st sourceState) {
+		k := fmt.Sprintf("%d %s", b.ID, st.key())
+		if len(seq) > 0 {
+			k += fmt.Sprintf(" %s:%d", seq[len(seq)-1].Pos.File, seq[len(seq)-1].Pos.Line)
+		}
+		if done[k] || visits >= maxPathVisits {
+			return
+		}
+		done[k] = true
+		visits++
+		onPath[b.ID] = true
+		path = append(path, b)
+		n := len(seq)
+
+		stopped := false
+		for _, stop := range stops[b.ID] {
+			if len(seq) > 0 && seq[len(seq)-1].Pos == stop.Pos {
+				continue
+			}
+			seq = append(seq, stop)
+			next := pc.step(st, stop.Pos)
+			if len(next.nodes) == 0 {
+				if len(seq) > 1 && pc.inFunction(seq[len(seq)-2].Pos) && pc.inFunction(stop.Pos) && succs.accepts(seq[len(seq)-2].Pos, stop.Pos) {
+					found(len(seq) - 1)
+					stopped = true
+					break
+				}
+				// already reported by check, or a line of another
+				// function, start again from the line
+				next = pc.containing(stop.Pos)
+			}
+			st = next
+		}
+
+		last := bg.Text[b.End-1]
+		if !stopped && (isRet(fn, last) || bg.isTailCall(last)) {
+			if len(seq) > 0 && seq[len(seq)-1].Pos.Line != -1 {
+				seq = append(seq, pathStop{Pos{"", -1}, last.Pc})
+				if len(pc.step(st, Pos{"", -1}).nodes) == 0 && len(seq) > 1 && pc.inFunction(seq[len(seq)-2].Pos) && succs.accepts(seq[len(seq)-2].Pos, Pos{"", -1}) {
+					found(len(seq) - 1)
+				}
+			}
+		} else if !stopped {
+			for _, e := range b.Out {
+				if !e.To.Morestack && !onPath[e.To.ID] && bg.Reachable(e.To) {
+					visit(e.To, st)
+				}
+			}
+		}
+
+		seq = seq[:n]
+		path = path[:len(path)-1]
+		onPath[b.ID] = false
+	}
+	visit(bg.Blocks[0], sourceState{nodes: []*Node{fn.Graph.Entry}})
+
+	if visits >= maxPathVisits {
+		printf(C, "%s: path enumeration stopped after %d blocks\n", fn.Name, visits)
+	}
+
+	penalty := 0
+	for _, key := range keys {
+		p := problems[key]
+		last := p.Lines[len(p.Lines)-1]
+		report(CatPath, p.Lines[len(p.Lines)-2].Pos, last.Pc, "no source path visits lines %s", pathString(p.Lines))
+		blocks := make([]string, len(p.Blocks))
+		for i, pc := range p.Blocks {
+			blocks[i] = fmt.Sprintf("%#x", pc)
+		}
+		printf(C, "\tpath %s\n\tlines %s\n", strings.Join(blocks, " "), pathString(p.Seq))
+		penalty += PathPenalty
+	}
+	return penalty
+}
+
+// pathString describes the lines of seq, the file is only given when it
+// changes.
+func pathString(seq []pathStop) string {
+	v := make([]string, len(seq))
+	file := ""
+	for i, stop := range seq {
+		switch {
+		case stop.Pos.Line == -1:
+			v[i] = "ret"
+		case stop.Pos.File != file:
+			file = stop.Pos.File
+			v[i] = fmt.Sprintf("%s:%d", filepath.Base(file), stop.Pos.Line)
+		default:
+			v[i] = fmt.Sprint(stop.Pos.Line)
+		}
+	}
+	return strings.Join(v, " ")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"go/ast"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const pathsSrc = `package main
+
+func f(n int, v interface{}) int {
+	s := 0
+	for i := 0; i < n; i++ {
+		s += i
+	}
+	if s > 10 {
+		s = 10
+	}
+	switch x := v.(type) {
+	case int:
+		s += x
+	}
+	return s
+}
+`
+
+func TestPathFeasible(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paths.go")
+	if err := os.WriteFile(path, []byte(pathsSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	funcs := []Function{{Name: "main.f"}}
+	var s Successors
+	s.FindSuccessors(path, []string{"main"}, funcs)
+	fn := &funcs[0]
+	x, ok := fn.Decl.(*ast.FuncDecl)
+	if !ok || fn.Graph == nil {
+		t.Fatal("no graph for main.f")
+	}
+	pc := &pathChecker{g: fn.Graph, start: s.ToPos(x.Pos()), end: s.ToPos(x.End()), stopped: map[Pos]bool{}, optional: map[ast.Node]bool{}}
+	ast.Inspect(x, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSwitchStmt); ok {
+			pc.optional[ts.Assign] = true
+		}
+		return true
+	})
+	for l := 3; l <= 16; l++ {
+		pc.stopped[Pos{path, l}] = true
+	}
+
+	for _, tc := range []struct {
+		lines []int
+		want  bool
+	}{
+		{[]int{4, 5, 6, 5, 6, 5, 8, 9, 11, 12, 13, 15}, true},
+		{[]int{4, 5, 8, 11, 15}, true},
+		{[]int{11, 13, 15}, true}, // the assignment is evaluated once, before the clause
+		{[]int{4, 6}, false},
+		{[]int{6, 4}, false},
+		{[]int{8, 9, 8}, false},
+		{[]int{5, 9}, false},
+		{[]int{15, 4}, false},
+	} {
+		seq := make([]pathStop, len(tc.lines))
+		for i, l := range tc.lines {
+			seq[i] = pathStop{Pos: Pos{path, l}}
+		}
+		if got := pc.feasible(pc.containing(seq[0].Pos), seq[1:]); got != tc.want {
+			t.Errorf("lines %v: feasible %v, want %v", tc.lines, got, tc.want)
+		}
+	}
+}
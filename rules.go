@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"sort"
+)
+
+// A Rule contributes nodes and edges to the control flow graph of a
+// function for the statements it recognizes.
+// Apply is called with the statement being visited, the nodes execution
+// could be at right before it and a Builder that can be used to add nodes
+// and edges to the graph and walk nested statements. It returns false if
+// it does not handle n, in which case the next rule of the rule set is
+// tried.
+type Rule interface {
+	Apply(n ast.Node, cur Frontier, b *Builder) bool
+}
+
+// RuleFunc adapts an ordinary function to the Rule interface.
+type RuleFunc func(n ast.Node, cur Frontier, b *Builder) bool
+
+func (f RuleFunc) Apply(n ast.Node, cur Frontier, b *Builder) bool {
+	return f(n, cur, b)
+}
+
+// RuleSet is an ordered list of rules, for each statement the first rule
+// that applies wins.
+type RuleSet []Rule
+
+// DefaultRules describes the control flow of all statements of the Go
+// language.
+var DefaultRules = RuleSet{
+	RuleFunc(declRule),
+	RuleFunc(goSendRule),
+	RuleFunc(deferRule),
+	RuleFunc(emptyRule),
+	RuleFunc(exprRule),
+	RuleFunc(forRule),
+	RuleFunc(rangeRule),
+	RuleFunc(ifRule),
+	RuleFunc(labeledRule),
+	RuleFunc(selectRule),
+	RuleFunc(switchRule),
+	RuleFunc(typeSwitchRule),
+	RuleFunc(branchRule),
+	RuleFunc(returnRule),
+}
+
+var ruleSets = map[string]RuleSet{
+	"default": DefaultRules,
+}
+
+// RegisterRuleSet makes a rule set selectable with the -rules option.
+// Rules are part of package main: a custom rule set is added by putting a
+// file in a copy of badnext that registers it from an init function and
+// rebuilding it. Rule sets will usually put their own rules in front of
+// DefaultRules, for example:
+//
+//	func init() {
+//		RegisterRuleSet("mydsl", append(RuleSet{RuleFunc(gotoStateRule)}, DefaultRules...))
+//	}
+func RegisterRuleSet(name string, rules RuleSet) {
+	if _, exists := ruleSets[name]; exists {
+		panic(fmt.Errorf("rule set %q registered twice", name))
+	}
+	ruleSets[name] = rules
+}
+
+// LookupRuleSet returns the rule set registered with name.
+func LookupRuleSet(name string) (RuleSet, bool) {
+	rules, ok := ruleSets[name]
+	return rules, ok
+}
+
+// RuleSetNames returns the names of all registered rule sets.
+func RuleSetNames() []string {
+	r := make([]string, 0, len(ruleSets))
+	for name := range ruleSets {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// NextStop is a stop where a next command can end.
+type NextStop struct {
+	Stop
+	Pc   uint64
+	Path []uint64 // starting stop, then the first address of each block leading to Pc
+}
+
+// blockOf returns the block containing the i-th instruction.
+func (bg *BlockGraph) blockOf(i int) *Block {
+	k := sort.Search(len(bg.Blocks), func(k int) bool { return bg.Blocks[k].End > i })
+	return bg.Blocks[k]
+}
+
+// isNextStop returns true if a next command started at cur stops at inst:
+// inst is a stop, on a different line, in the frame of cur or in one of
+// the frames it returns to. The instructions of all the calls inlined in
+// the frame of cur are stepped over, whatever line the calls are made
+// from.
+func isNextStop(cur Stop, inst AsmInstruction) bool {
+	switch inst.Helper {
+	case HelperNone, HelperSpill, HelperRestore:
+	default:
+		return false
+	}
+	return inst.IsStmt && commonInlined(inst.Inlined, cur.Inlined) == inst.Inlined && inst.Stop() != cur
+}
+
+// simulateNext returns the stops where a next command started at the
+// i-th instruction of fn would end, without entering calls. Each stop is
+// returned once, with the shortest path leading to it. Returning from fn
+// is a stop on line -1.
+func (bg *BlockGraph) simulateNext(fn *Function, exe *Executable, i int) []NextStop {
+	type visit struct {
+		b      *Block
+		start  int
+		pc     uint64
+		parent int // index in queue
+	}
+	cur := bg.Text[i].Stop()
+	queue := []visit{{bg.blockOf(i), i + 1, bg.Text[i].Pc, -1}}
+	seen := make([]bool, len(bg.Blocks))
+	r := []NextStop{}
+
+	path := func(k int) []uint64 {
+		p := []uint64{}
+		for ; k >= 0; k = queue[k].parent {
+			p = append(p, queue[k].pc)
+		}
+		for a, b := 0, len(p)-1; a < b; a, b = a+1, b-1 {
+			p[a], p[b] = p[b], p[a]
+		}
+		return p
+	}
+
+	add := func(stop Stop, pc uint64, k int) {
+		for _, ns := range r {
+			if ns.Stop == stop {
+				return
+			}
+		}
+		r = append(r, NextStop{stop, pc, path(k)})
+	}
+
+	for k := 0; k < len(queue); k++ {
+		v := queue[k]
+		stopped := false
+		for j := v.start; j < v.b.End; j++ {
+			if inst := bg.Text[j]; isNextStop(cur, inst) {
+				add(inst.Stop(), inst.Pc, k)
+				stopped = true
+				break
+			}
+		}
+		if stopped {
+			continue
+		}
+
+		last := bg.Text[v.b.End-1]
+		if isRet(fn, last) || bg.isTailCall(last) || (len(v.b.Out) == 0 && v.b.End == len(bg.Text) && !endsPath(exe, last)) {
+			add(Stop{Pos: Pos{"", -1}}, last.Pc, k)
+			continue
+		}
+
+		for _, e := range v.b.Out {
+			if e.To.Morestack || seen[e.To.ID] {
+				continue
+			}
+			seen[e.To.ID] = true
+			queue = append(queue, visit{e.To, e.To.Start, bg.Text[e.To.Start].Pc, k})
+		}
+	}
+	return r
+}
+
+// simulateNextFunction prints, for every stop of fn, the stops where a
+// next command would end and reports the ones that are not acceptable
+// successors, with the path leading to them. Returns the number of stops
+// and the number of unacceptable results.
+func simulateNextFunction(fn *Function, succs *Successors, exe *Executable) (nstops, nbad int) {
+	if fn.Decl == nil {
+		return 0, 0
+	}
+	printf(C, "FUNCTION %s\n", fn.Name)
+	bg := NewBlockGraph(fn.Text, exe)
+	for _, b := range bg.Blocks {
+		if !bg.Reachable(b) || b.Morestack {
+			continue
+		}
+		for i := b.Start; i < b.End; i++ {
+			inst := bg.Text[i]
+			if !inst.IsStmt || inst.Inst.Op == x86asm.UD1 || inst.Inst.Op == x86asm.UD2 {
+				continue
+			}
+			if inst.Helper != HelperNone && inst.Helper != HelperSpill && inst.Helper != HelperRestore {
+				continue
+			}
+			nstops++
+			cur := inst.Stop()
+			next := bg.simulateNext(fn, exe, i)
+			lines := make([]string, len(next))
+			for k, ns := range next {
+				lines[k] = stopString(ns.Stop)
+			}
+			printf(C, "%s %#x: next %s\n", stopString(cur), inst.Pc, strings.Join(lines, " "))
+			for _, ns := range next {
+				if succs.acceptStep(fn.Graph, cur, ns.Stop) {
+					continue
+				}
+				nbad++
+				path := make([]string, len(ns.Path))
+				for k, pc := range ns.Path {
+					path[k] = fmt.Sprintf("%#x", pc)
+				}
+				report(CatNext, cur.Pos, inst.Pc, "next stops at %s at %#x, path %s", stopString(ns.Stop), ns.Pc, strings.Join(path, " "))
+			}
+		}
+	}
+	printf(C, "\n")
+	return nstops, nbad
+}
+
+// stopString describes stop as file:line, followed by the inlined calls
+// containing it.
+func stopString(stop Stop) string {
+	if stop.Pos.Line == -1 {
+		return "ret"
+	}
+	s := fmt.Sprintf("%s:%d", filepath.Base(stop.Pos.File), stop.Pos.Line)
+	for ic := stop.Inlined; ic != nil; ic = ic.Parent {
+		s += "@" + ic.Name
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"debug/gosym"
+	"reflect"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+func TestSimulateNext(t *testing.T) {
+	ic := &InlinedCall{Name: "main.g", CallSite: Pos{"a.go", 12}}
+	inst := func(op x86asm.Op, file string, line int, inlined *InlinedCall, args ...x86asm.Arg) AsmInstruction {
+		r := AsmInstruction{Inst: x86asm.Inst{Op: op}, Pos: Pos{file, line}, IsStmt: op != x86asm.JE && op != x86asm.JMP, Inlined: inlined}
+		copy(r.Inst.Args[:], args)
+		return r
+	}
+	text := []AsmInstruction{
+		inst(x86asm.MOV, "a.go", 10, nil),
+		inst(x86asm.CMP, "a.go", 11, nil),
+		inst(x86asm.JE, "a.go", 11, nil, x86asm.Imm(0x1007)),
+		inst(x86asm.MOV, "b.go", 3, ic), // g inlined on line 12
+		inst(x86asm.MOV, "b.go", 4, ic),
+		inst(x86asm.MOV, "a.go", 12, nil),
+		inst(x86asm.JMP, "a.go", 12, nil, x86asm.Imm(0x1001)),
+		inst(x86asm.RET, "a.go", 14, nil),
+	}
+	for i := range text {
+		text[i].Pc = 0x1000 + uint64(i)
+	}
+	fn := &Function{Name: "main.f", Text: text}
+	exe := &Executable{Gosym: &gosym.Table{}}
+	bg := NewBlockGraph(text, exe)
+
+	for _, tc := range []struct {
+		start int
+		want  []int
+	}{
+		{0, []int{11}},
+		{1, []int{14, 12}}, // the inlined call is stepped over
+		{5, []int{11}},     // back to the condition of the loop
+		{3, []int{4}},      // inside the inlined call
+		{4, []int{12}},     // returning from the inlined call
+		{7, []int{-1}},     // return from the function
+	} {
+		got := []int{}
+		for _, ns := range bg.simulateNext(fn, exe, tc.start) {
+			got = append(got, ns.Pos.Line)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("next from instruction %d stops at lines %v, want %v", tc.start, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type sourcePackage struct {
+	ImportPath string
+	Dir        string
+	Files      []string
+}
+
+// SourceFunctions returns all functions matching pattern declared in the
+// packages matched by pkgpattern, without reading an executable. The
+// returned functions have no Text. Pkgpattern is either a directory or an
+// import path pattern understood by 'go list'. The files declaring the
+// functions are returned with the import paths of their packages.
+func SourceFunctions(pattern, pkgpattern string) ([]Function, map[string][]string) {
+	re := regexp.MustCompile(pattern)
+
+	pkgs, err := listPackages(pkgpattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load %s: %v\n", pkgpattern, err)
+		os.Exit(1)
+	}
+
+	r := []Function{}
+	files := map[string][]string{}
+	var fset token.FileSet
+
+	for _, pkg := range pkgs {
+		for _, path := range pkg.Files {
+			n, err := parser.ParseFile(&fset, path, nil, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			qual := pkg.ImportPath
+			if n.Name.Name == "main" {
+				qual = "main"
+			}
+			for _, decl := range n.Decls {
+				x, ok := decl.(*ast.FuncDecl)
+				if !ok || x.Body == nil {
+					continue
+				}
+				name := funcDeclName(&fset, qual, x)
+				if !re.MatchString(name) {
+					continue
+				}
+				r = append(r, Function{Name: name})
+				files[path] = []string{qual}
+			}
+		}
+	}
+	return r, files
+}
+
+// listPackages returns the packages matched by pkgpattern.
+func listPackages(pkgpattern string) ([]sourcePackage, error) {
+	dir := ""
+	if fi, err := os.Stat(pkgpattern); err == nil && fi.IsDir() {
+		dir = pkgpattern
+		pkgpattern = "."
+	}
+
+	cmd := exec.Command("go", "list", "-e", "-f", "{{.ImportPath}}\t{{.Dir}}\t{{join .GoFiles \"\\t\"}}\t{{join .CgoFiles \"\\t\"}}", pkgpattern)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if dir != "" {
+			// not inside a module or GOPATH, read the directory directly
+			return importDir(dir)
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	r := []sourcePackage{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 || fields[1] == "" {
+			continue
+		}
+		pkg := sourcePackage{ImportPath: fields[0], Dir: fields[1]}
+		for _, name := range fields[2:] {
+			if name != "" {
+				pkg.Files = append(pkg.Files, filepath.Join(pkg.Dir, name))
+			}
+		}
+		r = append(r, pkg)
+	}
+	return r, scanner.Err()
+}
+
+func importDir(dir string) ([]sourcePackage, error) {
+	bpkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	pkg := sourcePackage{ImportPath: bpkg.Name, Dir: absdir}
+	for _, name := range append(bpkg.GoFiles, bpkg.CgoFiles...) {
+		pkg.Files = append(pkg.Files, filepath.Join(absdir, name))
+	}
+	return []sourcePackage{pkg}, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// callDest returns the destination of the call at index i, part of b.
+// Indirect calls are resolved when the register or memory they go through
+// is loaded, in b, from a constant address: a function or a closure
+// without captured variables.
+func (bg *BlockGraph) callDest(exe *Executable, b *Block, i int) (uint64, bool) {
+	switch arg := bg.Text[i].Inst.Args[0].(type) {
+	case x86asm.Imm:
+		return uint64(arg), true
+	case x86asm.Reg:
+		return bg.regValue(exe, b, i, arg)
+	case x86asm.Mem:
+		if arg.Index != 0 || arg.Base == 0 {
+			return 0, false
+		}
+		addr, ok := bg.regValue(exe, b, i, arg.Base)
+		if !ok {
+			return 0, false
+		}
+		return exe.readPointer(addr + uint64(arg.Disp))
+	}
+	return 0, false
+}
+
+// regValue returns the value of reg before the instruction at index i,
+// part of b, if it is a constant. Calls and writes to any part of reg,
+// other than a load of all of it, make its value unknown.
+func (bg *BlockGraph) regValue(exe *Executable, b *Block, i int, reg x86asm.Reg) (uint64, bool) {
+	for j := i - 1; j >= b.Start; j-- {
+		inst := bg.Text[j]
+		if !writesReg(inst.Inst, reg) {
+			continue
+		}
+		if inst.Inst.Args[0] != reg {
+			return 0, false
+		}
+		switch src := inst.Inst.Args[1].(type) {
+		case x86asm.Imm:
+			if inst.Inst.Op == x86asm.MOV {
+				return uint64(src), true
+			}
+		case x86asm.Mem:
+			switch {
+			case inst.Inst.Op == x86asm.LEA && src.Base == x86asm.RIP:
+				return inst.Pc + uint64(inst.Inst.Len) + uint64(src.Disp), true
+			case inst.Inst.Op == x86asm.MOV && src.Index == 0 && src.Base != 0:
+				addr, ok := bg.regValue(exe, b, j, src.Base)
+				if !ok {
+					return 0, false
+				}
+				return exe.readPointer(addr + uint64(src.Disp))
+			}
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// writesReg returns true if inst can change the value of reg, or of a
+// part of it. Calls and instructions with implicit destinations are
+// assumed to change every register.
+func writesReg(inst x86asm.Inst, reg x86asm.Reg) bool {
+	switch inst.Op {
+	case x86asm.CALL, x86asm.SYSCALL, x86asm.CPUID, x86asm.RDTSC, x86asm.RDTSCP,
+		x86asm.MUL, x86asm.DIV, x86asm.IDIV, x86asm.CWD, x86asm.CDQ, x86asm.CQO,
+		x86asm.CBW, x86asm.CWDE, x86asm.CDQE, x86asm.CMPXCHG, x86asm.CMPXCHG8B, x86asm.CMPXCHG16B,
+		x86asm.MOVSB, x86asm.MOVSW, x86asm.MOVSD, x86asm.MOVSQ, x86asm.STOSB, x86asm.STOSW, x86asm.STOSD, x86asm.STOSQ,
+		x86asm.LODSB, x86asm.LODSW, x86asm.LODSD, x86asm.LODSQ:
+		return true
+	case x86asm.IMUL:
+		if inst.Args[1] == nil {
+			return true
+		}
+	case x86asm.CMP, x86asm.TEST, x86asm.BT, x86asm.PUSH:
+		return false
+	case x86asm.XCHG, x86asm.XADD:
+		if r, ok := inst.Args[1].(x86asm.Reg); ok && fullReg(r) == fullReg(reg) {
+			return true
+		}
+	}
+	r, ok := inst.Args[0].(x86asm.Reg)
+	return ok && fullReg(r) == fullReg(reg)
+}
+
+// fullReg returns the 64-bit general purpose register reg is a part of,
+// or reg itself if it is not part of one.
+func fullReg(reg x86asm.Reg) x86asm.Reg {
+	switch {
+	case reg >= x86asm.AH && reg <= x86asm.BH:
+		return x86asm.RAX + reg - x86asm.AH
+	case reg >= x86asm.AL && reg <= x86asm.BL:
+		return x86asm.RAX + reg - x86asm.AL
+	case reg >= x86asm.SPB && reg <= x86asm.R15B:
+		return x86asm.RSP + reg - x86asm.SPB
+	case reg >= x86asm.AX && reg <= x86asm.R15W:
+		return x86asm.RAX + reg - x86asm.AX
+	case reg >= x86asm.EAX && reg <= x86asm.R15L:
+		return x86asm.RAX + reg - x86asm.EAX
+	}
+	return reg
+}
+
+func (exe *Executable) readPointer(addr uint64) (uint64, bool) {
+	buf, err := exe.ReadMemory(addr, 8)
+	if err != nil {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(buf), true
+}
+
+// checkSteps checks where a debugger lands when stepping into each call of
+// fn and stepping out of it again. Stepping into a call stops at the entry
+// breakpoint of the callee (see EntryBreakpoint), which must be on the
+// line of its declaration or one of its first statements, or, if the
+// source of the callee was not parsed, on a line of its file after the
+// declaration. Stepping out stops at the return address, which must
+// belong to the inlined call of the call or to one containing it, when
+// the call ends an inlined body. Its line is checked by checkCalls.
+// Calls made by helper sequences and calls that can not be resolved are
+// not checked.
+func checkSteps(fn *Function, bg *BlockGraph, exe *Executable, succs *Successors) int {
+	penalty := 0
+	for _, b := range bg.Blocks {
+		if !bg.Reachable(b) || b.Morestack {
+			continue
+		}
+		for i := b.Start; i < b.End; i++ {
+			inst := fn.Text[i]
+			if inst.Inst.Op != x86asm.CALL || (inst.Helper != HelperNone && inst.Helper != HelperSpill && inst.Helper != HelperRestore) {
+				continue
+			}
+
+			if i+1 < len(fn.Text) && !isNoReturnCall(exe, inst) {
+				if ret := fn.Text[i+1]; commonInlined(ret.Inlined, inst.Inlined) != ret.Inlined {
+					report(CatStep, inst.Pos, inst.Pc, "stepping out returns to %s", stopString(ret.Stop()))
+					penalty += StepPenalty
+				}
+			}
+
+			dest, ok := bg.callDest(exe, b, i)
+			if !ok {
+				continue
+			}
+			callee := exe.FunctionAt(dest)
+			if callee == nil || len(callee.Text) == 0 {
+				continue
+			}
+			land := callee.Text[callee.EntryBreakpoint()]
+			printf(C, "step %#x: %s %s:%d\n", inst.Pc, callee.Name, land.Pos.File, land.Pos.Line)
+			if !acceptStepIn(callee, land, succs) {
+				report(CatStep, inst.Pos, inst.Pc, "stepping into %s stops at %s:%d", callee.Name, land.Pos.File, land.Pos.Line)
+				penalty += StepPenalty
+			}
+		}
+	}
+	return penalty
+}
+
+// acceptStepIn returns true if land is an acceptable place to stop at when
+// stepping into callee. The declaration of callee is the line of its first
+// instruction, part of the stack check.
+func acceptStepIn(callee *Function, land AsmInstruction, succs *Successors) bool {
+	decl := callee.Text[0].Pos
+	if land.Pos == decl {
+		return true
+	}
+	if set, parsed := succs.S[decl]; parsed {
+		return set.Contains(land.Pos)
+	}
+	return land.Pos.File == decl.File && land.Pos.Line > decl.Line
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"debug/gosym"
+	"testing"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+func TestRegValue(t *testing.T) {
+	exe := &Executable{Gosym: &gosym.Table{Funcs: []gosym.Func{
+		{Entry: 0x2000, End: 0x2100, Sym: &gosym.Sym{Name: "main.f"}},
+	}}}
+	inst := func(op x86asm.Op, args ...x86asm.Arg) x86asm.Inst {
+		var a x86asm.Args
+		copy(a[:], args)
+		return x86asm.Inst{Op: op, Args: a}
+	}
+	load := inst(x86asm.MOV, x86asm.RDX, x86asm.Imm(0x2000))
+
+	for _, tc := range []struct {
+		name string
+		text []x86asm.Inst
+		ok   bool
+	}{
+		{"load", []x86asm.Inst{load}, true},
+		{"other register", []x86asm.Inst{load, inst(x86asm.MOV, x86asm.RAX, x86asm.Imm(1))}, true},
+		{"compare", []x86asm.Inst{load, inst(x86asm.CMP, x86asm.RDX, x86asm.Imm(1))}, true},
+		{"call", []x86asm.Inst{load, inst(x86asm.CALL, x86asm.Imm(0x2000))}, false},
+		{"partial write", []x86asm.Inst{load, inst(x86asm.MOV, x86asm.EDX, x86asm.Imm(1))}, false},
+		{"byte write", []x86asm.Inst{load, inst(x86asm.MOV, x86asm.DL, x86asm.Imm(1))}, false},
+		{"exchange", []x86asm.Inst{load, inst(x86asm.XCHG, x86asm.RAX, x86asm.RDX)}, false},
+		{"pop", []x86asm.Inst{load, inst(x86asm.POP, x86asm.RDX)}, false},
+		{"implicit write", []x86asm.Inst{load, inst(x86asm.CQO)}, false},
+	} {
+		text := make([]AsmInstruction, len(tc.text)+1)
+		for i := range tc.text {
+			text[i] = AsmInstruction{Inst: tc.text[i], Pc: 0x1000 + uint64(i)}
+		}
+		text[len(tc.text)] = AsmInstruction{Inst: inst(x86asm.CALL, x86asm.RDX), Pc: 0x1000 + uint64(len(tc.text))}
+		bg := NewBlockGraph(text, exe)
+		i := len(text) - 1
+		v, ok := bg.callDest(exe, bg.blockOf(i), i)
+		if ok != tc.ok || (ok && v != 0x2000) {
+			t.Errorf("%s: got %#x %v, want ok %v", tc.name, v, ok, tc.ok)
+		}
+	}
+}